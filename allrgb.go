@@ -0,0 +1,27 @@
+package pix
+
+import "fmt"
+
+// The number of distinct 8-bit sRGB colors
+const numRGB = 1 << 24
+
+// Returns nPixels distinct sRGB colors without reference to a source image:
+// every 24-bit color if nPixels is 2^24, and otherwise a subset evenly spaced
+// along a Hilbert curve through the RGB cube, so that it covers the cube uniformly.
+// There is no source image to derive xy codes from, so colors are given their
+// position along the curve instead, which makes image-space sorting
+// a locality-preserving sort by color, and placed in a single row.
+func SampleAllRGB(nPixels int, opts SampleOptions) ([]SampledColor, error) {
+	if nPixels <= 0 || nPixels > numRGB {
+		return nil, fmt.Errorf("can only sample between 1 and %v distinct colors; got %v", numRGB, nPixels)
+	}
+	ret := make([]SampledColor, nPixels)
+	for i := range ret {
+		// integer arithmetic guarantees strictly increasing, and therefore distinct, indices
+		h := uint32(uint64(i) * numRGB / uint64(nPixels))
+		rgb := mortonCodeToColor(MortonCode(hilbertToMorton3D(h, 8)))
+		c := ImageColor{i, 0, rgb.x * 0x101, rgb.y * 0x101, rgb.z * 0x101}
+		ret[i] = sampleColor(c, h, opts)
+	}
+	return ret, nil
+}
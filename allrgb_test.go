@@ -0,0 +1,33 @@
+package pix
+
+import "testing"
+
+func TestSampleAllRGB(t *testing.T) {
+	w, h := 48, 32
+	colors, err := SampleAllRGB(w*h, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[Color]bool)
+	for _, c := range colors {
+		if seen[c.rgb] {
+			t.Fatalf("color %v was sampled twice", c.rgb)
+		}
+		seen[c.rgb] = true
+	}
+
+	canvas := placeAll(t, colors, Options{Width: w, Height: h, Unique: true})
+	if err := canvas.CheckUnique(colors); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// duplicated colors are caught
+	colors[1] = colors[0]
+	if err := canvas.CheckUnique(colors); err == nil {
+		t.Errorf("expected an error for duplicated colors")
+	}
+
+	if _, err := SampleAllRGB(numRGB+1, SampleOptions{}); err == nil {
+		t.Errorf("expected an error for more than %v colors", numRGB)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"image/png"
 	"math/rand"
 	"os"
-	"sort"
 )
 
 // A canvas represents a specific pixel-placed drawing
@@ -19,18 +18,40 @@ type Canvas struct {
 	nPlaced          int                     // number of pixels placed
 	inpaintCutoff    int                     // number of pixels beyond which to reject poor matches
 	w, h, wPad, hPad int                     // width and height, along with their 1-padded versions
+	highPrecision    bool                    // whether color codes are 10-bit rather than 8-bit
+	space            ColorSpace              // color space in which colors are matched
+	okLab            *OkLabTransform         // transform with which OkLab colors were quantized
+	rgb              []Color                 // exact placed srgb colors, if tracked (see Options.ExactColors)
+	exact            bool                    // whether to write the exact colors rather than decoding codes
+	rerank           Rerank                  // formula with which nearest candidates are re-ranked
+	rerankK          int                     // number of nearest candidates to re-rank
+	candidates       []MortonCode            // scratch space for the candidates
+	stats            *PlaceStats             // statistics to update during placement, if non-nil
 }
 
-func NewCanvas(w, h int, seed int64) *Canvas {
-	rng := rand.New(rand.NewSource(seed))
-	tree := newZipTree(rng)
+func NewCanvas(opts Options) *Canvas {
+	w, h := opts.Width, opts.Height
+	rng := rand.New(rand.NewSource(opts.RandomSeed))
+	tree := newZipTree(rng, codeMax(opts.HighPrecision), newAxisWeights(opts.AxisWeights))
 	wPad, hPad := w+2, h+2
 	img := make([]MortonCode, wPad*hPad) // init image data
 	ns := NewNeighbors(wPad, hPad)       // init empty neighbor-tracking structure
 	nPlaced := 0
 	inpaintCutoff := (w * h * 95) / 100
 	positions := make(map[MortonCode]*posList)
-	return &Canvas{tree, positions, rng, img, ns, nPlaced, inpaintCutoff, w, h, wPad, hPad}
+	exact := opts.ExactColors || opts.Unique
+	var rgb []Color
+	if exact || opts.Rerank != RerankNone {
+		rgb = make([]Color, wPad*hPad)
+	}
+	rerankK := opts.RerankK
+	if rerankK == 0 {
+		rerankK = DefaultRerankK
+	}
+	if opts.Unique {
+		inpaintCutoff = w * h // inpainting would replace colors with their neighbors'
+	}
+	return &Canvas{tree, positions, rng, img, ns, nPlaced, inpaintCutoff, w, h, wPad, hPad, opts.HighPrecision, opts.ColorSpace, opts.OkLab, rgb, exact, opts.Rerank, rerankK, nil, opts.Stats}
 }
 
 func (c *Canvas) Reset() {
@@ -39,62 +60,19 @@ func (c *Canvas) Reset() {
 	c.img = make([]MortonCode, c.wPad*c.hPad)
 	c.ns = NewNeighbors(c.wPad, c.hPad)
 	c.nPlaced = 0
+	if c.rgb != nil {
+		c.rgb = make([]Color, c.wPad*c.hPad)
+	}
 }
 
 // Represents a color sample in the RGB and OkLab color spaces,
-// along with its Morton and Hilbert codes.
+// along with its Morton and Hilbert codes. The RGB color is always
+// 8-bit; the OkLab color is 10-bit in high-precision mode.
 type SampledColor struct {
 	rgb, lab         Color
 	rgbCode, labCode MortonCode
 	xyCode           uint32
-	sortScore        float64
-}
-
-func SampleColors(src []ImageColor, nPixels int) []SampledColor {
-	nSrc, nDst := len(src), nPixels
-	ret := make([]SampledColor, nDst)
-	// center the hilbert curve in its power-of-2 bounding box so as
-	// not to unduly privilege one corner of the image over the others
-	srcW, srcH := src[nSrc-1].X, src[nSrc-1].Y
-	wOffset := int((pow2MoreThan(srcW) - uint32(srcW)) / 2)
-	hOffset := int((pow2MoreThan(srcH) - uint32(srcH)) / 2)
-	if nDst < nSrc {
-		// do expensive stuff once per dst
-		for i := 0; i < nDst; i++ {
-			pc := float64(i) / float64(nDst)
-			index := int(float64(nSrc) * pc)
-			c := src[index]
-			rgb := Color{c.R, c.G, c.B}
-			lab := rgbToOkLab(rgb)
-			rgbCode := mortonCode(rgb.x, rgb.y, rgb.z)
-			labCode := mortonCode(lab.x, lab.y, lab.z)
-			xyCode := xyToHilbert(uint32(c.X+wOffset), uint32(c.Y+hOffset), 16)
-			ret[i] = SampledColor{rgb, lab, rgbCode, labCode, xyCode, 0}
-		}
-	} else {
-		nMultiples := nDst / nSrc
-		index := 0
-		for _, c := range src {
-			rgb := Color{c.R, c.G, c.B}
-			lab := rgbToOkLab(rgb)
-			rgbCode := mortonCode(rgb.x, rgb.y, rgb.z)
-			labCode := mortonCode(lab.x, lab.y, lab.z)
-			xyCode := xyToHilbert(uint32(c.X+wOffset), uint32(c.Y+hOffset), 16)
-			x := SampledColor{rgb, lab, rgbCode, labCode, xyCode, 0}
-			for s := 0; s < nMultiples; s++ {
-				ret[index] = x
-				index++
-			}
-		}
-		nPlaced := nSrc * nMultiples
-		nRemaining := nDst - nPlaced
-		for i := 0; i < nRemaining; i++ {
-			pc := float64(i) / float64(nRemaining)
-			index := int(float64(nSrc) * pc)
-			ret[nPlaced+i] = ret[index]
-		}
-	}
-	return ret
+	x, y             int32 // position in the source image, or in the virtual image of SampleSources
 }
 
 func (c *Canvas) PlaceAt(code MortonCode, pos Pos) {
@@ -119,7 +97,12 @@ func (c *Canvas) PlaceAt(code MortonCode, pos Pos) {
 
 func (c *Canvas) PlaceSeed(color SampledColor, x, y int) {
 	// todo: check xy bounds
-	c.PlaceAt(color.labCode, Pos(rowMajorIndex(x+1, y+1, c.wPad)))
+	pos := Pos(rowMajorIndex(x+1, y+1, c.wPad))
+	if c.rgb != nil {
+		c.rgb[pos] = color.rgb
+	}
+	_, code := c.encode(color)
+	c.PlaceAt(code, pos)
 }
 
 func (c *Canvas) PlaceSeeds(colors []SampledColor, xys ...int) ([]SampledColor, error) {
@@ -145,65 +128,80 @@ func mortonCodeToColor(code MortonCode) Color {
 	return Color{mortonX(code), mortonY(code), mortonZ(code)}
 }
 
-type SortOptions struct {
-	Image, Color, Random float64
-	Reverse              bool
-}
-
-func SortBySimilarity(colors []SampledColor, opts SortOptions) {
-	rgbMax := float64(mortonCode(255, 255, 255))
-
-	// compute the smallest and largest Hilbert codes in order to
-	// properly normalize the XY component of the sort score
-	var _xyMax uint32 = 0 // compute over the codes actually used
-	var _xyMin uint32 = ^uint32(0)
-	for _, e := range colors {
-		if e.xyCode > _xyMax {
-			_xyMax = e.xyCode
-		}
-		if e.xyCode < _xyMin {
-			_xyMin = e.xyCode
-		}
+// Returns the color's codes in the canvas color space
+func (c *Canvas) encode(x SampledColor) (Color, MortonCode) {
+	if c.space == ColorSpaceOkLab {
+		return x.lab, x.labCode
 	}
-	xyMax := float64(_xyMax)
-	xyMin := float64(_xyMin)
-	xyDiff := xyMax - xyMin
-
-	order := 1.0
-	if opts.Reverse {
-		order = -1
-	}
-	random := opts.Random > 0
-	for i, e := range colors {
-		rgb := float64(e.rgbCode) / rgbMax
-		xy := (float64(e.xyCode) - xyMin) / xyDiff
-		score := float64(opts.Image*xy + opts.Color*rgb)
-		if random {
-			score += opts.Random * rand.Float64()
-		}
-		colors[i].sortScore = order * score
-	}
-	sort.Slice(colors, func(i, j int) bool { return colors[i].sortScore < colors[j].sortScore })
-
+	color := c.space.encode(x, c.tree.max, c.okLab)
+	return color, mortonCode(color.x, color.y, color.z)
 }
 
 func (c *Canvas) Place(x SampledColor) {
-	color, code := x.lab, x.labCode
-	nearest := c.tree.Nearest(color, code)
+	color, code := c.encode(x)
+	nearest := c.nearest(x, color, code)
 	inpaint := c.nPlaced > c.inpaintCutoff
+	pos := c.positions[nearest].arbitrary()
+	rgb := x.rgb
 	if inpaint {
 		nearestColor := mortonCodeToColor(nearest)
-		// have low tolerance for discrepancies in color
-		const maxDist = 10
-		if sqDist(color, nearestColor) > maxDist*maxDist {
+		// have low tolerance for discrepancies in color, as measured by the
+		// search, along the most heavily weighted axis
+		maxDist := uint64(10 * (uint32(c.tree.max) + 1) / 256)
+		if weightedSqDist(color, nearestColor, c.tree.w) > maxDist*maxDist*c.tree.w.max() {
 			code = nearest
+			if c.rgb != nil {
+				rgb = c.rgb[pos]
+			}
 		}
 	}
-	pos := c.positions[nearest].arbitrary()
 	targetPos := c.ns.RandEmptyNeighbor(pos, c.rng)
+	if c.rgb != nil {
+		c.rgb[targetPos] = rgb
+	}
 	c.PlaceAt(code, targetPos)
 }
 
+// Checks that the canvas holds each of the given colors exactly once, as it
+// should after they have been placed into a canvas of exactly the same size.
+func (c *Canvas) CheckUnique(colors []SampledColor) error {
+	if c.rgb == nil {
+		return fmt.Errorf("the canvas does not track exact colors")
+	}
+	if len(colors) != c.w*c.h {
+		return fmt.Errorf("%v colors do not fill a %vx%v canvas", len(colors), c.w, c.h)
+	}
+	// one bit per 24-bit color, set for colors that remain to be found on the canvas
+	remaining := make([]uint64, 1<<24/64)
+	for _, x := range colors {
+		i := rgbIndex(x.rgb)
+		if remaining[i/64]&(1<<(i%64)) != 0 {
+			return fmt.Errorf("color %v appears more than once among the colors", x.rgb)
+		}
+		remaining[i/64] |= 1 << (i % 64)
+	}
+	for y := 0; y < c.h; y++ {
+		for x := 0; x < c.w; x++ {
+			pos := Pos(rowMajorIndex(x+1, y+1, c.wPad))
+			if c.ns.Empty(pos) {
+				return fmt.Errorf("pixel (%v, %v) is empty", x, y)
+			}
+			rgb := c.rgb[pos]
+			i := rgbIndex(rgb)
+			if remaining[i/64]&(1<<(i%64)) == 0 {
+				return fmt.Errorf("color %v at (%v, %v) is duplicated or was never given", rgb, x, y)
+			}
+			remaining[i/64] &^= 1 << (i % 64)
+		}
+	}
+	return nil
+}
+
+// index of an 8-bit color in row-major order through the rgb cube
+func rgbIndex(rgb Color) uint32 { return uint32(rgb.x)<<16 | uint32(rgb.y)<<8 | uint32(rgb.z) }
+
+// Returns the canvas as 8-bit RGBA data. The colors of a high-precision
+// canvas are truncated to 8 bits.
 func (c *Canvas) ImageData() []uint8 {
 	// create a new buffer with an alpha channel then copy data over
 	nPixels := c.w * c.h
@@ -215,10 +213,19 @@ func (c *Canvas) ImageData() []uint8 {
 			code := c.img[isrc]
 			if c.ns.Empty(Pos(isrc)) {
 				data[idst], data[idst+1], data[idst+2], data[idst+3] = 0, 0, 0, 0
+			} else if c.exact {
+				rgb := c.rgb[isrc]
+				data[idst], data[idst+1], data[idst+2] = uint8(rgb.x), uint8(rgb.y), uint8(rgb.z)
+				data[idst+3] = 255
+			} else if c.highPrecision {
+				// 10-bit codes are decoded at 16 bits and truncated to 8
+				r, g, b := c.space.codeToRgb16(code, c.okLab)
+				data[idst], data[idst+1], data[idst+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+				data[idst+3] = 255
 			} else {
-				// note: we do round-trip through srgb -> linear srgb -> oklab -> linear rgb -> srgb.
+				// note: we do round-trip through srgb -> linear srgb -> working space -> linear rgb -> srgb.
 				// this handles the general case when placed colors do not correspond to a source image.
-				data[idst], data[idst+1], data[idst+2] = okLabCodeToRgb(code)
+				data[idst], data[idst+1], data[idst+2] = c.space.codeToRgb(code, c.okLab)
 				data[idst+3] = 255
 			}
 		}
@@ -226,9 +233,43 @@ func (c *Canvas) ImageData() []uint8 {
 	return data
 }
 
+// ImageData16 is like ImageData, but returns big-endian 16-bit RGBA
+// data from a high-precision canvas.
+func (c *Canvas) ImageData16() []uint8 {
+	nPixels := c.w * c.h
+	data := make([]uint8, 8*nPixels)
+	for y := 0; y < c.h; y++ {
+		for x := 0; x < c.w; x++ {
+			isrc := rowMajorIndex(x+1, y+1, c.wPad)
+			idst := 8 * rowMajorIndex(x, y, c.w)
+			if !c.ns.Empty(Pos(isrc)) {
+				var r, g, b uint16
+				if c.exact {
+					rgb := c.rgb[isrc]
+					r, g, b = rgb.x*0x101, rgb.y*0x101, rgb.z*0x101
+				} else {
+					r, g, b = c.space.codeToRgb16(c.img[isrc], c.okLab)
+				}
+				data[idst], data[idst+1] = uint8(r>>8), uint8(r)
+				data[idst+2], data[idst+3] = uint8(g>>8), uint8(g)
+				data[idst+4], data[idst+5] = uint8(b>>8), uint8(b)
+				data[idst+6], data[idst+7] = 255, 255
+			}
+		}
+	}
+	return data
+}
+
+// Saves the canvas as a PNG, which is 16-bit for a high-precision canvas.
 func (c *Canvas) SaveImage(path string, compressionLevel png.CompressionLevel) error {
-	data, w, h := c.ImageData(), c.w, c.h
+	w, h := c.w, c.h
 	r := image.Rectangle{image.Point{0, 0}, image.Point{w, h}}
+	var img image.Image
+	if c.highPrecision {
+		img = &image.RGBA64{Pix: c.ImageData16(), Stride: 8 * r.Dx(), Rect: r}
+	} else {
+		img = &image.RGBA{Pix: c.ImageData(), Stride: 4 * r.Dx(), Rect: r}
+	}
 
 	f, err := os.Create(path)
 	if err != nil {
@@ -237,7 +278,7 @@ func (c *Canvas) SaveImage(path string, compressionLevel png.CompressionLevel) e
 	defer f.Close()
 
 	enc := &png.Encoder{CompressionLevel: compressionLevel}
-	err = enc.Encode(f, &image.RGBA{Pix: data, Stride: 4 * r.Dx(), Rect: r})
+	err = enc.Encode(f, img)
 	if err != nil {
 		return fmt.Errorf("error writing output image: %w", err)
 	}
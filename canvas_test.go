@@ -0,0 +1,119 @@
+package pix
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestExactColors(t *testing.T) {
+	// random colors, many of which do not survive a round trip through OkLab
+	// codes, and far enough apart that inpainting replaces some of them
+	w, h := 40, 30
+	palette, colors := randomPalette(t, 200, w*h)
+	given := map[[3]uint8]bool{}
+	for _, c := range palette {
+		given[[3]uint8{c.R, c.G, c.B}] = true
+	}
+
+	for _, exact := range []bool{false, true} {
+		canvas := placeAll(t, colors, Options{Width: w, Height: h, ExactColors: exact})
+		missing := 0
+		data := canvas.ImageData()
+		for i := 0; i < len(data); i += 4 {
+			if !given[[3]uint8{data[i], data[i+1], data[i+2]}] {
+				missing++
+			}
+		}
+		if exact && missing > 0 {
+			t.Errorf("%v output pixels have colors that were not given", missing)
+		}
+		// pixels filled in by inpainting copy both the code and the exact color of a neighbor
+		for y := 0; exact && y < h; y++ {
+			for x := 0; x < w; x++ {
+				pos := rowMajorIndex(x+1, y+1, canvas.wPad)
+				if lab := rgbToOkLab(canvas.rgb[pos]); mortonCode(lab.x, lab.y, lab.z) != canvas.img[pos] {
+					t.Fatalf("the exact color %v at (%v, %v) does not match its code", canvas.rgb[pos], x, y)
+				}
+			}
+		}
+		if !exact && missing == 0 {
+			t.Errorf("reconstructing colors from OkLab codes reproduced every given color exactly")
+		}
+	}
+}
+
+// Returns a palette of size random colors, and n colors sampled
+// from it in random order.
+func randomPalette(t *testing.T, size, n int) ([]PaletteColor, []SampledColor) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	palette := make([]PaletteColor, size)
+	for i := range palette {
+		palette[i] = PaletteColor{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 1}
+	}
+	colors, err := SamplePalette(palette, n, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng.Shuffle(len(colors), func(i, j int) { colors[i], colors[j] = colors[j], colors[i] })
+	return palette, colors
+}
+
+// Places colors on a new canvas, starting from a seed at its center.
+func placeAll(t *testing.T, colors []SampledColor, opts Options) *Canvas {
+	t.Helper()
+	canvas := NewCanvas(opts)
+	rest, err := canvas.PlaceSeeds(colors, opts.Width/2, opts.Height/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rest {
+		canvas.Place(c)
+	}
+	return canvas
+}
+
+func TestImageDataHighPrecision(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]ImageColor, 64)
+	for i := range src {
+		src[i] = ImageColor{i % 8, i / 8, uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000))}
+	}
+	w, h := 8, 8
+	colors := mustSampleColors(t, src, w*h, SampleOptions{HighPrecision: true})
+	canvas := placeAll(t, colors, Options{Width: w, Height: h, HighPrecision: true})
+	// the 8-bit data holds the high bytes of the 16-bit data
+	data, data16 := canvas.ImageData(), canvas.ImageData16()
+	for i := range data {
+		if data[i] != data16[2*i] {
+			t.Fatalf("byte %v of the 8-bit data is %v; want %v", i, data[i], data16[2*i])
+		}
+	}
+}
+
+func TestInpaintWeighted(t *testing.T) {
+	// colors of equal lightness, which are identical under weights that ignore
+	// the other axes, so that inpainting never replaces them with a neighbor's
+	rng := rand.New(rand.NewSource(1))
+	w, h := 40, 30
+	var colors []SampledColor
+	seen := map[MortonCode]bool{}
+	for len(colors) < w*h {
+		lab := Color{128, uint16(rng.Intn(256)), uint16(rng.Intn(256))}
+		code := mortonCode(lab.x, lab.y, lab.z)
+		if !seen[code] {
+			seen[code] = true
+			colors = append(colors, SampledColor{lab: lab, labCode: code})
+		}
+	}
+	canvas := placeAll(t, colors, Options{Width: w, Height: h, AxisWeights: [3]float64{1, 0, 0}})
+	placed := map[MortonCode]bool{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			placed[canvas.img[rowMajorIndex(x+1, y+1, canvas.wPad)]] = true
+		}
+	}
+	if len(placed) != len(colors) {
+		t.Errorf("the canvas holds %v distinct colors; want all %v", len(placed), len(colors))
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
 	"image/png"
 	"log"
 	"os"
@@ -15,15 +16,45 @@ import (
 )
 
 func main() {
-	input := flag.String("in", "", "input image (required!)")
 	output := flag.String("out", "", "output image")
 	width := flag.Int("width", 300, "width of the output image")
 	height := flag.Int("height", 300, "height of the output image")
 	color := flag.Int("colorsort", 90, "magic parameter (0 to 100) determining sort order. A higher value will give more weight to color similarity, while lower values will better preserve proximity in the source image.")
 	random := flag.Int("random", 0, "randomness weight for similarity sort")
+	lightness := flag.Float64("lightness", 0, "OkLCh lightness weight for similarity sort, on the same scale as -colorsort")
+	chroma := flag.Float64("chroma", 0, "OkLCh chroma weight for similarity sort, on the same scale as -colorsort")
+	hue := flag.Float64("hue", 0, "OkLCh hue weight for similarity sort, on the same scale as -colorsort")
+	hueStart := flag.Float64("hue-start", 0, "hue angle in degrees at which the hue sort order begins (0 is pinkish red, 110 yellow, 264 blue)")
+	radial := flag.Float64("radial", 0, "weight for distance from the -focus point in the source image, on the same scale as -colorsort")
+	angular := flag.Float64("angular", 0, "weight for angle around the -focus point, measured clockwise from -direction, on the same scale as -colorsort")
+	directional := flag.Float64("directional", 0, "weight for position along a sweep across the source image in -direction, on the same scale as -colorsort")
+	direction := flag.Float64("direction", 0, "direction of the -directional sweep in degrees (0 is left to right, 90 top to bottom)")
+	focus := [2]float64{0.5, 0.5}
+	flag.Func("focus", "focal point for -radial and -angular as fractions of the source width and height: 'fx fy' (default '0.5 0.5', the center)", func(s string) error {
+		pieces := strings.Fields(s)
+		if len(pieces) != 2 {
+			return fmt.Errorf("focus must specify two coordinates")
+		}
+		for i, piece := range pieces {
+			f, err := strconv.ParseFloat(piece, 64)
+			if err != nil {
+				return err
+			}
+			focus[i] = f
+		}
+		return nil
+	})
+	shuffleWindow := flag.Int("shuffle-window", 0, "after sorting, swap each color with a random one among the next n to add texture while keeping the overall order")
+	maxDisplacement := flag.Int("max-displacement", 0, "after sorting, randomly move each color by at most n places")
+	exportOrder := flag.String("export-order", "", "write the order in which sorted colors are placed to a file: csv for .csv (index,x,y,r,g,b), binary otherwise")
+	importOrder := flag.String("import-order", "", "skip sorting and place colors in the order given by a file written by -export-order or an external tool: a list of indices into the sampled colors")
+	hueReverse := flag.Bool("hue-reverse", false, "order hues clockwise (red towards blue) rather than counterclockwise (red towards yellow)")
 	reverse := flag.Bool("reverse", true, "reverse sort order")
 	sweep := flag.Bool("sweep", false, "sweep across {colorsort, random, reverse, seeds} parameters, ignoring any explicitly set values")
-	seed := flag.Int64("random-seed", 0, "random seed")
+	seed := flag.Int64("random-seed", 0, "random seed. sampling and sorting use this seed, and variation n (numbered from 1) places pixels with seed random-seed + n, so reruns with the same flags give identical output")
+	alpha := flag.Int("alpha", 1, "alpha threshold (0 to 255); source pixels with lower alpha are excluded from the palette")
+	highPrecision := flag.Bool("16bit", false, "high-precision mode: keep 16-bit source colors, match colors with 10 bits per channel, and write 16-bit png output")
+	orient := flag.Bool("orient", true, "rotate and flip jpeg inputs upright according to their exif orientation")
 	variations := flag.Int("variations", 1, "number of outputs to generate for each set of input parameters")
 
 	var compressionLevel png.CompressionLevel
@@ -39,6 +70,198 @@ func main() {
 		return nil
 	})
 
+	var inputs []string
+	flag.Func("in", "input image, or - to read from stdin (required!). repeat to mix colors from several images", func(s string) error {
+		inputs = append(inputs, s)
+		return nil
+	})
+
+	var masks []string
+	flag.Func("mask", "grayscale mask image giving the inclusion weight of each input pixel (black excludes a pixel). repeat to give one mask per input image, in order", func(s string) error {
+		masks = append(masks, s)
+		return nil
+	})
+
+	var crop image.Rectangle
+	flag.Func("crop", "only sample input pixels within the rectangle 'x0 y0 x1 y1'", func(s string) error {
+		var c [4]int
+		pieces := strings.Fields(s)
+		if len(pieces) != len(c) {
+			return fmt.Errorf("crop must specify four coordinates")
+		}
+		for i, piece := range pieces {
+			n, err := strconv.Atoi(piece)
+			if err != nil {
+				return err
+			}
+			c[i] = n
+		}
+		crop = image.Rect(c[0], c[1], c[2], c[3])
+		if crop.Empty() {
+			return fmt.Errorf("crop rectangle is empty")
+		}
+		return nil
+	})
+
+	palette := flag.String("palette", "", "palette file (.gpl, .hex, .act, .csv) to use as the color source instead of input images")
+	allRGB := flag.Bool("allrgb", false, "use distinct colors evenly spread through the rgb cube as the color source instead of input images; a 4096x4096 output uses every 24-bit color exactly once")
+	exact := flag.Bool("exact", false, "write each pixel's exact source color rather than reconstructing it from the color it was matched as, so that the output contains only input colors (8-bit even with -16bit)")
+	gradient := flag.Bool("gradient", false, "fill the palette out with OkLab gradients between consecutive palette colors")
+
+	evenUpsampling := flag.Bool("even-upsampling", false, "when the output has more pixels than the input, spread repeated source colors evenly rather than topping up from the start of the image")
+
+	strategy := pix.StrategyRowMajor
+	strategies := map[string]pix.Strategy{
+		"rowmajor":   pix.StrategyRowMajor,
+		"stratified": pix.StrategyStratified,
+		"random":     pix.StrategyRandom,
+		"average":    pix.StrategyAreaAverage,
+	}
+	flag.Func("sampling", "strategy for sampling colors from a larger input: rowmajor, stratified, random, or average (default rowmajor)", func(s string) error {
+		var ok bool
+		if strategy, ok = strategies[s]; !ok {
+			return fmt.Errorf("unknown sampling strategy (valid values: rowmajor, stratified, random, average)")
+		}
+		return nil
+	})
+
+	colorCurve := pix.ColorCurveMortonRGB
+	colorCurves := map[string]pix.ColorCurve{
+		"morton-rgb":    pix.ColorCurveMortonRGB,
+		"hilbert-rgb":   pix.ColorCurveHilbertRGB,
+		"morton-oklab":  pix.ColorCurveMortonOkLab,
+		"hilbert-oklab": pix.ColorCurveHilbertOkLab,
+	}
+	flag.Func("colorcurve", "space-filling curve through color space used by -colorsort: morton-rgb, hilbert-rgb, morton-oklab, or hilbert-oklab (default morton-rgb). hilbert curves avoid jumps between distant colors", func(s string) error {
+		var ok bool
+		if colorCurve, ok = colorCurves[s]; !ok {
+			return fmt.Errorf("unknown color curve (valid values: morton-rgb, hilbert-rgb, morton-oklab, hilbert-oklab)")
+		}
+		return nil
+	})
+
+	colorSpace := pix.ColorSpaceOkLab
+	colorSpaces := map[string]pix.ColorSpace{
+		"oklab":  pix.ColorSpaceOkLab,
+		"cielab": pix.ColorSpaceCIELAB,
+		"linear": pix.ColorSpaceLinearRGB,
+		"srgb":   pix.ColorSpaceSRGB,
+		"ycbcr":  pix.ColorSpaceYCbCr,
+	}
+	flag.Func("colorspace", "color space in which colors are matched during placement: oklab, cielab, linear, srgb, or ycbcr (default oklab)", func(s string) error {
+		var ok bool
+		if colorSpace, ok = colorSpaces[s]; !ok {
+			return fmt.Errorf("unknown color space (valid values: oklab, cielab, linear, srgb, ycbcr)")
+		}
+		return nil
+	})
+
+	var axisWeights [3]float64
+	flag.Func("axis-weights", "relative weights of the three axes of -colorspace when matching colors, eg. '2 1 1' to weight OkLab lightness over a and b so that tonal structure stays clean while hue wanders (default '1 1 1')", func(s string) error {
+		pieces := strings.Fields(s)
+		if len(pieces) != len(axisWeights) {
+			return fmt.Errorf("axis weights must specify three weights")
+		}
+		for i, piece := range pieces {
+			f, err := strconv.ParseFloat(piece, 64)
+			if err != nil {
+				return err
+			}
+			if !(f >= 0) {
+				return fmt.Errorf("axis weights must be nonnegative")
+			}
+			axisWeights[i] = f
+		}
+		return nil
+	})
+
+	okLabFit := "fixed"
+	flag.Func("oklab-fit", "range of OkLab colors that is quantized: fixed (the whole sRGB gamut), isotropic (fitted to the input colors, scaling every axis alike) or anisotropic (stretching each axis to fill the range, which exaggerates differences along narrow axes). fitting helps muted inputs (default fixed)", func(s string) error {
+		if s != "fixed" && s != "isotropic" && s != "anisotropic" {
+			return fmt.Errorf("unknown oklab fit (valid values: fixed, isotropic, anisotropic)")
+		}
+		okLabFit = s
+		return nil
+	})
+
+	rerank := pix.RerankNone
+	reranks := map[string]pix.Rerank{
+		"none":      pix.RerankNone,
+		"oklab":     pix.RerankOkLab,
+		"ciede2000": pix.RerankCIEDE2000,
+	}
+	flag.Func("rerank", "re-rank the -rerank-k nearest candidates of each color by their exact colors with a color difference formula: none, oklab (unquantized OkLab distance) or ciede2000 (default none). exact colors are 8-bit even with -16bit. implies -stats", func(s string) error {
+		var ok bool
+		if rerank, ok = reranks[s]; !ok {
+			return fmt.Errorf("unknown re-ranking formula (valid values: none, oklab, ciede2000)")
+		}
+		return nil
+	})
+	rerankK := flag.Int("rerank-k", pix.DefaultRerankK, "number of nearest candidates to re-rank with -rerank")
+	stats := flag.Bool("stats", false, "print the time spent placing colors and, with -rerank, how re-ranking changed the matches")
+
+	var sortExpr *pix.SortExpr
+	flag.Func("sort", "custom sort score expression replacing -colorsort, -random and the OkLCh weights, eg. '0.6*hue + 0.3*xy - 0.1*L'. pass -sort help to list the variables and functions", func(s string) error {
+		if s == "help" {
+			fmt.Print(pix.SortExprHelp())
+			os.Exit(0)
+		}
+		var err error
+		sortExpr, err = pix.CompileSortExpr(s)
+		return err
+	})
+
+	var sortKeys []pix.SortKey
+	flag.Func("sortkeys", "lexicographic sort keys, separated by semicolons: each a -sort expression optionally followed by :n to split its range into n bands, eg. 'L:5; hue:12; xy'. negate a key to sort it in descending order", func(s string) error {
+		for _, piece := range strings.Split(s, ";") {
+			var key pix.SortKey
+			src := piece
+			if i := strings.LastIndex(piece, ":"); i >= 0 {
+				n, err := strconv.Atoi(strings.TrimSpace(piece[i+1:]))
+				if err != nil || n < 1 {
+					return fmt.Errorf("invalid bucket count in sort key %q", piece)
+				}
+				src, key.Buckets = piece[:i], n
+			}
+			var err error
+			if key.Expr, err = pix.CompileSortExpr(src); err != nil {
+				return err
+			}
+			sortKeys = append(sortKeys, key)
+		}
+		return nil
+	})
+
+	weighting := pix.WeightingUniform
+	weightings := map[string]pix.Weighting{
+		"uniform":  pix.WeightingUniform,
+		"edges":    pix.WeightingEdges,
+		"saliency": pix.WeightingSaliency,
+	}
+	flag.Func("weighting", "weight input pixels by their content when sampling: uniform, edges (local contrast), or saliency (default uniform)", func(s string) error {
+		var ok bool
+		if weighting, ok = weightings[s]; !ok {
+			return fmt.Errorf("unknown weighting (valid values: uniform, edges, saliency)")
+		}
+		return nil
+	})
+	uniformMix := flag.Float64("uniform-mix", 0, "blend -weighting with uniform sampling, from 0 (content-weighted) to 1 (uniform)")
+
+	var weights []float64
+	flag.Func("weights", "relative weight of each input image in the palette: 'w[ w...]' (default: equal weights)", func(s string) error {
+		for _, piece := range strings.Fields(s) {
+			w, err := strconv.ParseFloat(piece, 64)
+			if err != nil {
+				return err
+			}
+			if w < 0 {
+				return fmt.Errorf("weights must not be negative")
+			}
+			weights = append(weights, w)
+		}
+		return nil
+	})
+
 	var seeds []int
 	flag.Func("seeds", "seed positions: 'x y[ x y...]'", func(s string) error {
 		pieces := strings.Split(s, " ")
@@ -57,36 +280,111 @@ func main() {
 
 	flag.Parse()
 
-	if *input == "" {
-		fmt.Println("please specify an input image via the -in flag.")
+	nColorSources := 0
+	for _, given := range []bool{len(inputs) > 0, *palette != "", *allRGB} {
+		if given {
+			nColorSources++
+		}
+	}
+	if nColorSources == 0 {
+		fmt.Println("please specify an input image via the -in flag, a palette via the -palette flag, or use the -allrgb flag.")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if nColorSources > 1 {
+		log.Fatalf("only one of the -in, -palette and -allrgb flags can be used at a time")
+	}
+	nStdin := 0
+	for _, input := range inputs {
+		if input == "-" {
+			nStdin++
+		}
+	}
+	if nStdin > 1 {
+		log.Fatalf("stdin can only be used as one of the inputs")
+	}
+	if *palette != "" && weights != nil {
+		log.Fatalf("the -weights flag applies to input images; palette weights are given in the palette file")
+	}
+	if *sweep && (*exportOrder != "" || *importOrder != "") {
+		log.Fatalf("the -sweep flag sorts colors several ways, so it cannot be combined with -export-order or -import-order")
+	}
+	if masks != nil && len(masks) != len(inputs) {
+		log.Fatalf("got %v masks for %v input images", len(masks), len(inputs))
+	}
+	if weights == nil {
+		for range inputs {
+			weights = append(weights, 1)
+		}
+	} else if len(weights) != len(inputs) {
+		log.Fatalf("got %v weights for %v input images", len(weights), len(inputs))
+	}
 
 	image := new(int)
 	*image = 100 - *color
 
-	// If no output file is specified, generate a file name based on the input.
+	// If no output file is specified, generate a file name based on the (first) input.
+	// Input read from stdin has no name, so fall back to "pix.png".
 	if *output == "" {
-		_, file := path.Split(*input)
 		wd, err := os.Getwd()
 		if err != nil {
 			log.Fatalf("could not get working directory: %v", err)
 		}
-		ext := path.Ext(file)
-		if ext != ".png" {
-			file = file[:len(file)-len(ext)] + ".png"
+		source := *palette
+		if len(inputs) > 0 {
+			source = inputs[0]
+		}
+		if *allRGB {
+			*output = path.Join(wd, "pix.allrgb.png")
+		} else if source == "-" {
+			*output = path.Join(wd, "pix.png")
+		} else {
+			_, file := path.Split(source)
+			ext := path.Ext(file)
+			if ext != ".png" {
+				file = file[:len(file)-len(ext)] + ".png"
+			}
+			*output = path.Join(wd, "pix."+file)
 		}
-		*output = path.Join(wd, "pix."+file)
 	}
 	// Parse the output path into components in order to synthesize variation outputs
 	dir, file := path.Split(*output)
 	ext := path.Ext(file)
 	name := file[:len(file)-len(ext)]
 
-	img, err := pix.LoadImage(*input)
-	if err != nil {
-		log.Fatalf("failed to load image: %v", err)
+	if *uniformMix < 0 || *uniformMix > 1 {
+		log.Fatalf("uniform mix out of range (valid values: 0 to 1)")
+	}
+	if *alpha < 0 || *alpha > 255 {
+		log.Fatalf("alpha threshold out of range (valid values: 0 to 255)")
+	}
+	loadOpts := pix.LoadOptions{
+		AlphaThreshold:    uint8(*alpha),
+		HighPrecision:     *highPrecision,
+		IgnoreOrientation: !*orient,
+		Crop:              crop,
+	}
+
+	sources := make([]pix.Source, len(inputs))
+	for i, input := range inputs {
+		var img []pix.ImageColor
+		var err error
+		if input == "-" {
+			img, err = pix.LoadImageFrom(os.Stdin, loadOpts)
+		} else {
+			img, err = pix.LoadImage(input, loadOpts)
+		}
+		if err != nil {
+			log.Fatalf("failed to load image %v: %v", input, err)
+		}
+		sources[i] = pix.Source{Colors: img, Weight: weights[i]}
+		if masks != nil {
+			mask, err := pix.LoadMask(masks[i], !*orient)
+			if err != nil {
+				log.Fatalf("failed to load mask %v: %v", masks[i], err)
+			}
+			sources[i].Mask = mask
+		}
 	}
 
 	w, h := *width, *height
@@ -98,6 +396,10 @@ func main() {
 	var imageSweep, randomSweep []int
 	var seedsSweep [][]int
 	var reverseSweep []bool
+	if *rerankK < 1 {
+		log.Fatalf("-rerank-k must be positive")
+	}
+
 	if *sweep {
 		imageSweep = []int{10, 90}
 		randomSweep = []int{0, 10}
@@ -124,10 +426,57 @@ func main() {
 		go worker(id, jobs, results)
 	}
 
-	// Sample colors from the image
-	colors := pix.SampleColors(img, w*h)
+	// Sample colors from the images or palette
+	sampleOpts := pix.SampleOptions{
+		HighPrecision:  *highPrecision,
+		Strategy:       strategy,
+		Seed:           *seed,
+		EvenUpsampling: *evenUpsampling,
+		Weighting:      weighting,
+		UniformMix:     *uniformMix,
+	}
+	var colors []pix.SampledColor
+	var err error
+	fit, anisotropic := okLabFit != "fixed", okLabFit == "anisotropic"
+	if *allRGB {
+		if fit {
+			log.Fatalf("the -allrgb colors span the whole sRGB gamut, so -oklab-fit does not apply")
+		}
+		colors, err = pix.SampleAllRGB(w*h, sampleOpts)
+	} else if *palette != "" {
+		var p []pix.PaletteColor
+		p, err = pix.LoadPalette(*palette)
+		if err != nil {
+			log.Fatalf("failed to load palette: %v", err)
+		}
+		if fit {
+			sampleOpts.OkLab = pix.FitOkLabPalette(p, anisotropic)
+		}
+		if *gradient {
+			colors, err = pix.SampleGradient(p, w*h, sampleOpts)
+		} else {
+			colors, err = pix.SamplePalette(p, w*h, sampleOpts)
+		}
+	} else {
+		if fit {
+			sampleOpts.OkLab = pix.FitOkLab(sources, sampleOpts, anisotropic)
+		}
+		colors, err = pix.SampleSources(sources, w*h, sampleOpts)
+	}
+	if err != nil {
+		log.Fatalf("failed to sample colors: %v", err)
+	}
+	var order []uint32
+	if *importOrder != "" {
+		order, err = pix.LoadOrder(*importOrder)
+		if err != nil {
+			log.Fatalf("failed to load order: %v", err)
+		}
+	}
 
-	// Generate variations
+	// Generate variations. Everything random is seeded from -random-seed: the sort for
+	// each set of sort parameters uses it directly, and variations are numbered from 1
+	// in the order of the loops below, with variation n using seed + n for placement.
 	variation := 0
 	for _, image := range imageSweep {
 		for _, random := range randomSweep {
@@ -140,8 +489,42 @@ func main() {
 					Color:   float64(100 - image),
 					Random:  float64(random),
 					Reverse: reverse,
+					Seed:    *seed,
+
+					Lightness:  *lightness,
+					Chroma:     *chroma,
+					Hue:        *hue,
+					HueStart:   *hueStart,
+					HueReverse: *hueReverse,
+					ColorCurve: colorCurve,
+					Expr:       sortExpr,
+					Keys:       sortKeys,
+
+					ShuffleWindow:   *shuffleWindow,
+					MaxDisplacement: *maxDisplacement,
+
+					Radial:      *radial,
+					Angular:     *angular,
+					Directional: *directional,
+					FocusX:      focus[0],
+					FocusY:      focus[1],
+					Direction:   *direction,
+				}
+				if order != nil {
+					if err := pix.ApplyOrder(sortedColors, order); err != nil {
+						log.Fatalf("failed to apply order %v: %v", *importOrder, err)
+					}
+				} else if *exportOrder != "" {
+					sortOrder := pix.SortOrder(colors, sortOpts)
+					if err := pix.SaveOrder(*exportOrder, colors, sortOrder); err != nil {
+						log.Fatalf("failed to save order: %v", err)
+					}
+					if err := pix.ApplyOrder(sortedColors, sortOrder); err != nil {
+						log.Fatalf("failed to apply order: %v", err)
+					}
+				} else {
+					pix.SortBySimilarity(sortedColors, sortOpts)
 				}
-				pix.SortBySimilarity(sortedColors, sortOpts)
 
 				for _, seeds := range seedsSweep {
 					if len(seeds) == 0 {
@@ -170,9 +553,21 @@ func main() {
 							Sort:             sortOpts,
 							RandomSeed:       *seed + int64(variation),
 							CompressionLevel: compressionLevel,
+							HighPrecision:    *highPrecision,
+							ColorSpace:       colorSpace,
+							OkLab:            sampleOpts.OkLab,
+							AxisWeights:      axisWeights,
+							ExactColors:      *exact,
+							Unique:           *allRGB,
+							Rerank:           rerank,
+							RerankK:          *rerankK,
 							Output:           path.Join(dir, name+variationTag+ext),
 						}
 
+						if *stats || rerank != pix.RerankNone {
+							opts.Stats = &pix.PlaceStats{}
+						}
+
 						status := fmt.Sprintf("generating variation %v: seeds:%v, colorsort: %v, random: %v, reverse: %v\n", variation, seedsString, sortOpts.Color, sortOpts.Random, sortOpts.Reverse)
 						jobs <- Work{sortedColors, opts, status}
 					}
@@ -204,7 +599,25 @@ func worker(id int, jobs <-chan Work, results chan<- bool) {
 			fmt.Printf("!!! error placing pixels: %v\n", err)
 			results <- false
 		} else {
+			if opts.Stats != nil {
+				printStats(opts.Output, opts.Rerank != pix.RerankNone, opts.Stats)
+			}
 			results <- true
 		}
 	}
 }
+
+func printStats(output string, rerank bool, s *pix.PlaceStats) {
+	msg := fmt.Sprintf("%v: placed %v colors in %v (search %v", output, s.Placed, s.PlaceTime, s.SearchTime)
+	if rerank {
+		msg += fmt.Sprintf(", re-rank %v)", s.RerankTime)
+		if s.Placed > 0 {
+			n := float64(s.Placed)
+			msg += fmt.Sprintf("; re-ranking changed %.1f%% of matches, mean ΔE %.4g -> %.4g",
+				100*float64(s.Changed)/n, s.BaseDeltaE/n, s.DeltaE/n)
+		}
+	} else {
+		msg += ")"
+	}
+	fmt.Println(msg)
+}
@@ -10,14 +10,26 @@ import (
 // Note: We assume colors are given to us in nonlinear srgb, which
 // we convert to linear RGB and then OkLab.
 
-// Color represents a color in linear RGB or OkLab
-type Color struct{ x, y, z uint8 }
+// Color represents a color in linear RGB or OkLab, with each
+// channel quantized to 8 bits (or 10 bits in high-precision mode)
+type Color struct{ x, y, z uint16 }
 
-// quantize a float in [0,1] to a uint8
-func quantize(x float64) uint8 { return uint8(255*x + 0.5) }
+// The largest channel values of 8-bit and 10-bit colors
+const max8, max10 = 255, 1023
 
-// remap a uint8 to [0, 1] float
-func invQuantize(x uint8) float64 { return float64(x) / 255 }
+// The largest channel value of OkLab codes at the given precision
+func codeMax(highPrecision bool) uint16 {
+	if highPrecision {
+		return max10
+	}
+	return max8
+}
+
+// quantize a float in [0,1] to an integer in [0, max]
+func quantize(x float64, max uint16) uint16 { return uint16(float64(max)*x + 0.5) }
+
+// remap an integer in [0, max] to [0, 1] float
+func invQuantize(x, max uint16) float64 { return float64(x) / float64(max) }
 
 // remap from [0, 1] to [lo, hi]
 func remap(x, lo, hi float64) float64 { return (x - lo) / (hi - lo) }
@@ -41,42 +53,77 @@ func clamp(x, lo, hi float64) float64 {
 const aLo, aHi = -0.23388757418790818, 0.2762167534925238
 const bLo, bHi = -0.3115281476783751, 0.19856975465179516
 
+// convert an 8-bit sRGB color to OkLab quantized to 8 bits
 func rgbToOkLab(rgb Color) Color {
+	return linearRgbToOkLab(
+		toLinearRGB(rgb.x, max8),
+		toLinearRGB(rgb.y, max8),
+		toLinearRGB(rgb.z, max8),
+		max8)
+}
+
+// convert a 16-bit sRGB color to OkLab quantized to 10 bits
+func rgb16ToOkLab(r, g, b uint16) Color {
+	return linearRgbToOkLab(
+		toLinearRGB(r, 0xffff),
+		toLinearRGB(g, 0xffff),
+		toLinearRGB(b, 0xffff),
+		max10)
+}
+
+// The largest OkLab chroma of any sRGB color, attained by magenta (255, 0, 255)
+const maxOkLabChroma = 0.3225
+
+// convert an 8-bit sRGB color to unquantized OkLCh, with hue in degrees in [0, 360)
+func rgbToOkLCh(rgb Color) (L, C, h float64) {
 	L, a, b := linear_srgb_to_oklab(
-		toLinearRGB(rgb.x),
-		toLinearRGB(rgb.y),
-		toLinearRGB(rgb.z))
+		toLinearRGB(rgb.x, max8),
+		toLinearRGB(rgb.y, max8),
+		toLinearRGB(rgb.z, max8))
+	h = math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return L, math.Hypot(a, b), h
+}
+
+func linearRgbToOkLab(r, g, b float64, max uint16) Color {
+	L, A, B := linear_srgb_to_oklab(r, g, b)
+	return quantizeOkLab(L, A, B, max)
+}
+
+// quantize OkLab coordinates within the sRGB gamut to integers in [0, max]
+func quantizeOkLab(L, a, b float64, max uint16) Color {
 	return Color{
-		quantize(L),
-		// Rescaling these by translation leaves a lot of dynamic range on the table.
-		// Could compute a tighter bounding cube by finding the largest scale factor
-		// by which to linearly rescale all dimensions s. t. the smallest and largest
-		// values across any channel are 0 and 1.
-		quantize(a - aLo),
-		quantize(b - bLo)}
-}
-
-func okLabCodeToRgb(code MortonCode) (uint8, uint8, uint8) {
-	r, g, b := oklab_to_linear_srgb(
-		invQuantize(mortonX(code)),
-		invQuantize(mortonY(code))+aLo,
-		invQuantize(mortonZ(code))+bLo)
-	// floating-point imprecision can cause values to exceed 1
-	r, g, b = clamp(r, 0, 1), clamp(g, 0, 1), clamp(b, 0, 1)
+		quantize(L, max),
+		// Rescaling these by translation leaves a lot of dynamic range on the table;
+		// an OkLabTransform fitted to the colors at hand makes use of it.
+		quantize(a-aLo, max),
+		quantize(b-bLo, max)}
+}
+
+// convert an 8-bit OkLab code, quantized with the transform t, to 8-bit sRGB
+func okLabCodeToRgb(code MortonCode, t *OkLabTransform) (uint8, uint8, uint8) {
+	r, g, b := okLabCodeToLinearRgb(code, max8, t)
 	return toNonlinearRGBLUT(r), toNonlinearRGBLUT(g), toNonlinearRGBLUT(b)
 }
 
+// convert a 10-bit OkLab code, quantized with the transform t, to 16-bit sRGB
+func okLabCodeToRgb16(code MortonCode, t *OkLabTransform) (uint16, uint16, uint16) {
+	r, g, b := okLabCodeToLinearRgb(code, max10, t)
+	return toNonlinearRGB16(r), toNonlinearRGB16(g), toNonlinearRGB16(b)
+}
+
+func okLabCodeToLinearRgb(code MortonCode, max uint16, t *OkLabTransform) (float64, float64, float64) {
+	r, g, b := oklab_to_linear_srgb(t.dequantize(code, max))
+	// floating-point imprecision can cause values to exceed 1
+	return clamp(r, 0, 1), clamp(g, 0, 1), clamp(b, 0, 1)
+}
+
 // note: can also be optimize w/ a lookup table if needed.
-func toLinearRGB(x uint8) float64 {
-	// remap to [0, 1]
-	y := invQuantize(x)
-	// apply the inverse srgb nonlinearity
-	if y >= 0.04045 {
-		y = math.Pow((y+0.055)/(1+0.055), 2.4)
-	} else {
-		y = y / 12.92
-	}
-	return y
+func toLinearRGB(x, max uint16) float64 {
+	// remap to [0, 1] and apply the inverse srgb nonlinearity
+	return linearize(invQuantize(x, max))
 }
 
 // this function takes a long time for larger images because math.Pow is slow.
@@ -116,13 +163,28 @@ func generateNonlinearRGBLookupTable() {
 }
 
 func toNonlinearRGB(x float64) uint8 {
-	// apply the srgb nonlinearity
+	return uint8(quantize(nonlinearize(x), max8))
+}
+
+// there is no lookup table for 16-bit output, so this one is slow.
+func toNonlinearRGB16(x float64) uint16 {
+	return quantize(nonlinearize(x), 0xffff)
+}
+
+// apply the inverse srgb nonlinearity
+func linearize(x float64) float64 {
+	if x >= 0.04045 {
+		return math.Pow((x+0.055)/(1+0.055), 2.4)
+	}
+	return x / 12.92
+}
+
+// apply the srgb nonlinearity
+func nonlinearize(x float64) float64 {
 	if x >= 0.0031308 {
-		x = 1.055*math.Pow(x, 1/2.4) - 0.055
-	} else {
-		x = 12.92 * x
+		return 1.055*math.Pow(x, 1/2.4) - 0.055
 	}
-	return quantize(x)
+	return 12.92 * x
 }
 
 // The original code uses float32, but Go's built-in math.Cbrt is float64-only
@@ -0,0 +1,38 @@
+package pix
+
+import "testing"
+
+func TestOkLabRoundTrip(t *testing.T) {
+	// round-tripping through quantized OkLab should approximately preserve sRGB colors,
+	// with high precision doing substantially better than 8 bits. errors are in 8-bit units.
+	absDiff := func(a, b float64) float64 {
+		if a > b {
+			return a - b
+		}
+		return b - a
+	}
+	var n, err8, err16 float64
+	for r := 0; r < 256; r += 15 {
+		for g := 0; g < 256; g += 15 {
+			for b := 0; b < 256; b += 15 {
+				lab := rgbToOkLab(Color{uint16(r), uint16(g), uint16(b)})
+				r8, g8, b8 := okLabCodeToRgb(mortonCode(lab.x, lab.y, lab.z), nil)
+				e8 := absDiff(float64(r), float64(r8)) + absDiff(float64(g), float64(g8)) + absDiff(float64(b), float64(b8))
+
+				lab = rgb16ToOkLab(uint16(r)*0x101, uint16(g)*0x101, uint16(b)*0x101)
+				r16, g16, b16 := okLabCodeToRgb16(mortonCode(lab.x, lab.y, lab.z), nil)
+				e16 := (absDiff(float64(r*0x101), float64(r16)) + absDiff(float64(g*0x101), float64(g16)) + absDiff(float64(b*0x101), float64(b16))) / 0x101
+
+				if e8 > 3*16 || e16 > 3*4 {
+					t.Errorf("%v %v %v round-tripped to %v %v %v (8-bit) and %v %v %v (16-bit)", r, g, b, r8, g8, b8, r16, g16, b16)
+				}
+				n++
+				err8 += e8
+				err16 += e16
+			}
+		}
+	}
+	if err16/n > err8/n/2 {
+		t.Errorf("mean high-precision error %v is not much lower than mean 8-bit error %v", err16/n, err8/n)
+	}
+}
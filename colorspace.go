@@ -0,0 +1,158 @@
+package pix
+
+import "math"
+
+// A ColorSpace is the space in which colors are matched during placement.
+// Each space is quantized to codes of the same precision as OkLab (8 or 10
+// bits per channel), with every channel scaled by the same factor so that
+// distances between codes stay proportional to distances in the space.
+type ColorSpace int
+
+const (
+	// OkLab, which is perceptually uniform
+	ColorSpaceOkLab ColorSpace = iota
+	// CIELAB with a D65 white point, an older perceptual space
+	// that is less uniform in hue than OkLab
+	ColorSpaceCIELAB
+	// Linear-light RGB, which weights bright colors more heavily than the eye does
+	ColorSpaceLinearRGB
+	// Gamma-encoded sRGB, as stored in images
+	ColorSpaceSRGB
+	// Full-range BT.601 YCbCr over sRGB, as used by JPEG
+	ColorSpaceYCbCr
+)
+
+// Minimum and maximum values for CIELAB's a and b parameters
+// found by enumerating all 8-bit RGB colors and taking the extrema.
+// All three channels are divided by the largest extent, that of b,
+// and L, which lies in [0, 100], is not shifted.
+const cieALo, cieAHi = -86.18271642053466, 98.23431188800397
+const cieBLo, cieBHi = -107.8601617541481, 94.47797505367026
+const cieScale = cieBHi - cieBLo
+
+// D65 reference white in CIE XYZ
+const whiteX, whiteY, whiteZ = 0.95047, 1.0, 1.08883
+
+// Converts the color to codes in the working color space. OkLab codes are
+// computed when colors are sampled, so that their precision can reflect
+// 16-bit sources. Other spaces are converted from the 8-bit sRGB color,
+// or in high-precision mode from the OkLab codes, quantized with t.
+func (s ColorSpace) encode(x SampledColor, max uint16, t *OkLabTransform) Color {
+	if s == ColorSpaceOkLab {
+		return x.lab
+	}
+	var r, g, b float64
+	if max == max8 {
+		r, g, b = toLinearRGB(x.rgb.x, max8), toLinearRGB(x.rgb.y, max8), toLinearRGB(x.rgb.z, max8)
+	} else {
+		r, g, b = okLabCodeToLinearRgb(x.labCode, max, t)
+	}
+	return s.quantizeLinear(r, g, b, max)
+}
+
+// Quantizes a linear RGB color in [0, 1] to codes in the color space.
+// OkLab codes use the fixed range; see OkLabTransform.
+func (s ColorSpace) quantizeLinear(r, g, b float64, max uint16) Color {
+	switch s {
+	case ColorSpaceOkLab:
+		return linearRgbToOkLab(r, g, b, max)
+	case ColorSpaceCIELAB:
+		L, A, B := linearRgbToCIELAB(r, g, b)
+		return Color{
+			quantize(clamp(L/cieScale, 0, 1), max),
+			quantize((A-cieALo)/cieScale, max),
+			quantize((B-cieBLo)/cieScale, max)}
+	case ColorSpaceLinearRGB:
+		return Color{quantize(r, max), quantize(g, max), quantize(b, max)}
+	case ColorSpaceSRGB:
+		return Color{quantize(nonlinearize(r), max), quantize(nonlinearize(g), max), quantize(nonlinearize(b), max)}
+	case ColorSpaceYCbCr:
+		Y, Cb, Cr := srgbToYCbCr(nonlinearize(r), nonlinearize(g), nonlinearize(b))
+		return Color{quantize(Y, max), quantize(Cb+0.5, max), quantize(Cr+0.5, max)}
+	}
+	panic("quantizeLinear: unknown color space")
+}
+
+// Converts codes in the color space back to a linear RGB color, clamped
+// to [0, 1] since codes need not lie within the sRGB gamut. OkLab codes
+// are quantized with t.
+func (s ColorSpace) decode(code MortonCode, max uint16, t *OkLabTransform) (float64, float64, float64) {
+	x, y, z := invQuantize(mortonX(code), max), invQuantize(mortonY(code), max), invQuantize(mortonZ(code), max)
+	switch s {
+	case ColorSpaceOkLab:
+		return okLabCodeToLinearRgb(code, max, t)
+	case ColorSpaceCIELAB:
+		r, g, b := cielabToLinearRGB(x*cieScale, y*cieScale+cieALo, z*cieScale+cieBLo)
+		return clamp(r, 0, 1), clamp(g, 0, 1), clamp(b, 0, 1)
+	case ColorSpaceLinearRGB:
+		return x, y, z
+	case ColorSpaceSRGB:
+		return linearize(x), linearize(y), linearize(z)
+	case ColorSpaceYCbCr:
+		r, g, b := yCbCrToSRGB(x, y-0.5, z-0.5)
+		return linearize(clamp(r, 0, 1)), linearize(clamp(g, 0, 1)), linearize(clamp(b, 0, 1))
+	}
+	panic("decode: unknown color space")
+}
+
+// convert a code in the color space to 8-bit sRGB
+func (s ColorSpace) codeToRgb(code MortonCode, t *OkLabTransform) (uint8, uint8, uint8) {
+	if s == ColorSpaceOkLab {
+		return okLabCodeToRgb(code, t)
+	}
+	r, g, b := s.decode(code, max8, t)
+	return toNonlinearRGBLUT(r), toNonlinearRGBLUT(g), toNonlinearRGBLUT(b)
+}
+
+// convert a 10-bit code in the color space to 16-bit sRGB
+func (s ColorSpace) codeToRgb16(code MortonCode, t *OkLabTransform) (uint16, uint16, uint16) {
+	if s == ColorSpaceOkLab {
+		return okLabCodeToRgb16(code, t)
+	}
+	r, g, b := s.decode(code, max10, t)
+	return toNonlinearRGB16(r), toNonlinearRGB16(g), toNonlinearRGB16(b)
+}
+
+func linearRgbToCIELAB(r, g, b float64) (float64, float64, float64) {
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / whiteX
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / whiteY
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / whiteZ
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+func cielabToLinearRGB(L, a, b float64) (float64, float64, float64) {
+	fy := (L + 16) / 116
+	x, y, z := labFInv(fy+a/500)*whiteX, labFInv(fy)*whiteY, labFInv(fy-b/200)*whiteZ
+	return +3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		+0.0556434*x - 0.2040259*y + 1.0572252*z
+}
+
+// The CIELAB companding function, which is linear near zero
+func labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func labFInv(f float64) float64 {
+	if f3 := f * f * f; f3 > 216.0/24389 {
+		return f3
+	}
+	return (116*f - 16) * 27 / 24389
+}
+
+// Cb and Cr lie in [-0.5, 0.5]
+func srgbToYCbCr(r, g, b float64) (float64, float64, float64) {
+	return 0.299*r + 0.587*g + 0.114*b,
+		-0.168736*r - 0.331264*g + 0.5*b,
+		0.5*r - 0.418688*g - 0.081312*b
+}
+
+func yCbCrToSRGB(y, cb, cr float64) (float64, float64, float64) {
+	return y + 1.402*cr,
+		y - 0.344136*cb - 0.714136*cr,
+		y + 1.772*cb
+}
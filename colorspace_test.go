@@ -0,0 +1,51 @@
+package pix
+
+import (
+	"math"
+	"testing"
+)
+
+func TestColorSpaceRoundTrip(t *testing.T) {
+	// round-tripping through each space's 10-bit codes should approximately
+	// preserve sRGB colors, including the corners of the gamut. the perceptual
+	// spaces spend less precision on dark colors, which err by more levels.
+	spaces := map[string]struct {
+		space     ColorSpace
+		tolerance float64
+	}{
+		"oklab":  {ColorSpaceOkLab, 8},
+		"cielab": {ColorSpaceCIELAB, 8},
+		"linear": {ColorSpaceLinearRGB, 2},
+		"srgb":   {ColorSpaceSRGB, 1},
+		"ycbcr":  {ColorSpaceYCbCr, 1},
+	}
+	for name, test := range spaces {
+		space := test.space
+		var worst float64
+		for r := 0; r < 256; r += 15 {
+			for g := 0; g < 256; g += 15 {
+				for b := 0; b < 256; b += 15 {
+					c := space.quantizeLinear(toLinearRGB(uint16(r), max8), toLinearRGB(uint16(g), max8), toLinearRGB(uint16(b), max8), max10)
+					if c.x > max10 || c.y > max10 || c.z > max10 {
+						t.Fatalf("%v: %v %v %v has out-of-range codes %v", name, r, g, b, c)
+					}
+					r16, g16, b16 := space.codeToRgb16(mortonCode(c.x, c.y, c.z), nil)
+					for _, d := range [][2]int{{r, int(r16)}, {g, int(g16)}, {b, int(b16)}} {
+						worst = math.Max(worst, math.Abs(float64(d[0])-float64(d[1])/0x101))
+					}
+				}
+			}
+		}
+		if worst > test.tolerance {
+			t.Errorf("%v: colors round-tripped with an error of up to %v 8-bit levels", name, worst)
+		}
+	}
+
+	// 8-bit sRGB codes are the colors themselves
+	for _, v := range []uint16{0, 1, 128, 254, 255} {
+		c := ColorSpaceSRGB.encode(sampleColor(ImageColor{0, 0, v * 0x101, 0, 0xffff}, 0, SampleOptions{}), max8, nil)
+		if r, g, b := ColorSpaceSRGB.codeToRgb(mortonCode(c.x, c.y, c.z), nil); r != uint8(v) || g != 0 || b != 255 {
+			t.Errorf("sRGB %v 0 255 round-tripped to %v %v %v", v, r, g, b)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// This file implements just enough EXIF parsing to find the orientation
+// of a JPEG image, along with the transformations needed to undo it:
+// https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+
+// Returns the EXIF orientation (1 to 8) of the JPEG data, or 1 if it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	// walk the marker segments until we find the APP1 segment holding the EXIF data
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+		// start of scan or end of image; there is no more metadata
+		if marker == 0xda || marker == 0xd9 {
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+// Returns the orientation tag from the first IFD of the TIFF-structured EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		tag, typ := order.Uint16(tiff[entry:]), order.Uint16(tiff[entry+2:])
+		const orientationTag, shortType = 0x0112, 3
+		if tag == orientationTag && typ == shortType {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// Returns a copy of the *image.RGBA or *image.RGBA64 transformed so that it displays
+// upright according to the EXIF orientation, or the image itself if no change is needed.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	var pix []uint8
+	var stride, bpp int
+	switch img := img.(type) {
+	case *image.RGBA:
+		pix, stride, bpp = img.Pix, img.Stride, 4
+	case *image.RGBA64:
+		pix, stride, bpp = img.Pix, img.Stride, 8
+	default:
+		panic("applyOrientation: unsupported image type")
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		// orientations 5-8 swap the axes
+		dstW, dstH = h, w
+	}
+	dst := make([]uint8, dstW*dstH*bpp)
+	for dy := 0; dy < dstH; dy++ {
+		for dx := 0; dx < dstW; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // rotated 180°
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // needs a 90° clockwise rotation
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // needs a 90° counterclockwise rotation
+				sx, sy = w-1-dy, dx
+			}
+			isrc := sy*stride + sx*bpp
+			idst := (dy*dstW + dx) * bpp
+			copy(dst[idst:idst+bpp], pix[isrc:isrc+bpp])
+		}
+	}
+	r := image.Rect(0, 0, dstW, dstH)
+	if bpp == 4 {
+		return &image.RGBA{Pix: dst, Stride: 4 * dstW, Rect: r}
+	}
+	return &image.RGBA64{Pix: dst, Stride: 8 * dstW, Rect: r}
+}
@@ -0,0 +1,116 @@
+package pix
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// Returns a JPEG APP1 segment containing an EXIF orientation tag
+func exifSegment(orientation uint16, bigEndian bool) []byte {
+	u16 := func(x uint16) []byte {
+		if bigEndian {
+			return []byte{byte(x >> 8), byte(x)}
+		}
+		return []byte{byte(x), byte(x >> 8)}
+	}
+	u32 := func(x uint32) []byte {
+		if bigEndian {
+			return []byte{byte(x >> 24), byte(x >> 16), byte(x >> 8), byte(x)}
+		}
+		return []byte{byte(x), byte(x >> 8), byte(x >> 16), byte(x >> 24)}
+	}
+	var tiff []byte
+	if bigEndian {
+		tiff = append(tiff, "MM"...)
+	} else {
+		tiff = append(tiff, "II"...)
+	}
+	tiff = append(tiff, u16(42)...)
+	tiff = append(tiff, u32(8)...)
+	tiff = append(tiff, u16(2)...) // two entries, the first of which is irrelevant
+	tiff = append(tiff, u16(0x010f)...)
+	tiff = append(tiff, u16(2)...)
+	tiff = append(tiff, u32(4)...)
+	tiff = append(tiff, "abc\x00"...)
+	tiff = append(tiff, u16(0x0112)...)
+	tiff = append(tiff, u16(3)...)
+	tiff = append(tiff, u32(1)...)
+	tiff = append(tiff, u16(orientation)...)
+	tiff = append(tiff, 0, 0)
+	tiff = append(tiff, u32(0)...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	n := len(payload) + 2
+	return append([]byte{0xff, 0xe1, byte(n >> 8), byte(n)}, payload...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	withExif := func(o uint16, bigEndian bool) []byte {
+		data := append([]byte{}, plain[:2]...)
+		data = append(data, exifSegment(o, bigEndian)...)
+		return append(data, plain[2:]...)
+	}
+	tests := []struct {
+		data []byte
+		want int
+	}{
+		{plain, 1},
+		{withExif(6, false), 6},
+		{withExif(8, true), 8},
+		{withExif(3, true), 3},
+		{withExif(9, false), 1}, // out of range
+		{[]byte("not a jpeg"), 1},
+	}
+	for i, test := range tests {
+		if got := jpegOrientation(test.data); got != test.want {
+			t.Errorf("test %v: got %v; want %v", i, got, test.want)
+		}
+	}
+
+	// the decoder should also understand files with the EXIF segment
+	if _, err := jpeg.Decode(bytes.NewReader(withExif(6, false))); err != nil {
+		t.Errorf("could not decode jpeg with exif segment: %v", err)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// a 3x2 image whose red channel holds 1-based pixel indices:
+	// 1 2 3
+	// 4 5 6
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Pix[4*i] = uint8(i + 1)
+	}
+	tests := []struct {
+		orientation int
+		w           int
+		want        []uint8
+	}{
+		{1, 3, []uint8{1, 2, 3, 4, 5, 6}},
+		{2, 3, []uint8{3, 2, 1, 6, 5, 4}},
+		{3, 3, []uint8{6, 5, 4, 3, 2, 1}},
+		{4, 3, []uint8{4, 5, 6, 1, 2, 3}},
+		{5, 2, []uint8{1, 4, 2, 5, 3, 6}},
+		{6, 2, []uint8{4, 1, 5, 2, 6, 3}},
+		{7, 2, []uint8{6, 3, 5, 2, 4, 1}},
+		{8, 2, []uint8{3, 6, 2, 5, 1, 4}},
+	}
+	for _, test := range tests {
+		dst := applyOrientation(src, test.orientation).(*image.RGBA)
+		if dst.Bounds().Dx() != test.w {
+			t.Errorf("orientation %v: got width %v; want %v", test.orientation, dst.Bounds().Dx(), test.w)
+			continue
+		}
+		for i, want := range test.want {
+			if got := dst.Pix[4*i]; got != want {
+				t.Errorf("orientation %v: pixel %v: got %v; want %v", test.orientation, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package pix
+
+// This file implements a small expression language for custom sort scores, such as
+// "0.6*hue + 0.3*xy - 0.1*L + 0.05*rand". Expressions combine numbers and per-color
+// variables using + - * / ^ (power), parentheses and a handful of functions. They
+// are compiled once into a tree of closures and then evaluated for every color.
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type sortVar int
+
+const (
+	varXY sortVar = iota
+	varX
+	varY
+	varR
+	varG
+	varB
+	varOkL
+	varOkA
+	varOkB
+	varChroma
+	varHue
+	varMortonRGB
+	varHilbertRGB
+	varMortonOkLab
+	varHilbertOkLab
+	varRand
+	numSortVars
+)
+
+// The variables available to sort expressions. Unless noted otherwise they lie in [0, 1].
+var sortVars = []struct {
+	name, doc string
+}{
+	varXY:           {"xy", "Hilbert position in the source, normalized over the sampled colors"},
+	varX:            {"x", "source x position, normalized over the sampled colors"},
+	varY:            {"y", "source y position, normalized over the sampled colors"},
+	varR:            {"r", "sRGB red"},
+	varG:            {"g", "sRGB green"},
+	varB:            {"b", "sRGB blue"},
+	varOkL:          {"L", "OkLab lightness"},
+	varOkA:          {"A", "OkLab a, roughly between -0.25 and 0.3"},
+	varOkB:          {"B", "OkLab b, roughly between -0.3 and 0.2"},
+	varChroma:       {"C", "OkLCh chroma, relative to the largest sRGB chroma"},
+	varHue:          {"hue", "OkLCh hue angle as a fraction of a turn from 0°"},
+	varMortonRGB:    {"morton_rgb", "position along the Morton curve over sRGB"},
+	varHilbertRGB:   {"hilbert_rgb", "position along the Hilbert curve over sRGB"},
+	varMortonOkLab:  {"morton_oklab", "position along the Morton curve over OkLab"},
+	varHilbertOkLab: {"hilbert_oklab", "position along the Hilbert curve over OkLab"},
+	varRand:         {"rand", "uniform random number"},
+}
+
+var sortFuncs1 = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"floor": math.Floor,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+}
+
+var sortFuncs2 = map[string]func(float64, float64) float64{
+	"min": math.Min,
+	"max": math.Max,
+	// like math.Mod, but with the sign of the divisor, so that eg. mod(hue - 0.25, 1) wraps around
+	"mod": func(x, y float64) float64 { return x - y*math.Floor(x/y) },
+}
+
+var curveVars = []struct {
+	v     sortVar
+	curve ColorCurve
+}{
+	{varMortonRGB, ColorCurveMortonRGB},
+	{varHilbertRGB, ColorCurveHilbertRGB},
+	{varMortonOkLab, ColorCurveMortonOkLab},
+	{varHilbertOkLab, ColorCurveHilbertOkLab},
+}
+
+// Returns a description of the variables and functions available to sort expressions.
+func SortExprHelp() string {
+	var sb strings.Builder
+	sb.WriteString("variables:\n")
+	for _, v := range sortVars {
+		fmt.Fprintf(&sb, "  %-14v %v\n", v.name, v.doc)
+	}
+	sb.WriteString("functions: abs, sqrt, floor, sin, cos, min(x, y), max(x, y), mod(x, y)\n")
+	return sb.String()
+}
+
+// A SortExpr is a compiled sort score expression; see CompileSortExpr.
+type SortExpr struct {
+	src  string
+	eval func(vars *[numSortVars]float64) float64
+	uses [numSortVars]bool // the variables the expression refers to
+}
+
+// Compiles an expression computing the sort score of each color from the
+// variables listed by SortExprHelp.
+func CompileSortExpr(src string) (*SortExpr, error) {
+	p := exprParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	e := &SortExpr{src: src}
+	p.expr = e
+	eval, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %v", t)
+	}
+	e.eval = eval
+	return e, nil
+}
+
+func (e *SortExpr) String() string {
+	return e.src
+}
+
+// The ranges over which SortBySimilarity normalizes source positions
+type sortBounds struct {
+	xyMin, xyDiff, xMin, xDiff, yMin, yDiff float64
+}
+
+// Evaluates the expression for c, computing only the variables it uses.
+// NaN, as from sqrt(-1) or 0/0, would break the sort, so it scores as +Inf.
+func (e *SortExpr) score(c SampledColor, b *sortBounds, vars *[numSortVars]float64, rng *rand.Rand) float64 {
+	u := &e.uses
+	if u[varXY] {
+		vars[varXY] = (float64(c.xyCode) - b.xyMin) / b.xyDiff
+	}
+	if u[varX] {
+		vars[varX] = (float64(c.x) - b.xMin) / b.xDiff
+	}
+	if u[varY] {
+		vars[varY] = (float64(c.y) - b.yMin) / b.yDiff
+	}
+	vars[varR], vars[varG], vars[varB] = invQuantize(c.rgb.x, max8), invQuantize(c.rgb.y, max8), invQuantize(c.rgb.z, max8)
+	if u[varOkL] || u[varOkA] || u[varOkB] || u[varChroma] || u[varHue] {
+		L, a, b := linear_srgb_to_oklab(toLinearRGB(c.rgb.x, max8), toLinearRGB(c.rgb.y, max8), toLinearRGB(c.rgb.z, max8))
+		vars[varOkL], vars[varOkA], vars[varOkB] = L, a, b
+		vars[varChroma] = math.Hypot(a, b) / maxOkLabChroma
+		h := math.Atan2(b, a) / (2 * math.Pi)
+		if h < 0 {
+			h++
+		}
+		vars[varHue] = h
+	}
+	for _, cv := range curveVars {
+		if u[cv.v] {
+			vars[cv.v] = float64(curveCode(c, cv.curve)) / float64(mortonCode(max8, max8, max8))
+		}
+	}
+	if u[varRand] {
+		vars[varRand] = rng.Float64()
+	}
+	if v := e.eval(vars); !math.IsNaN(v) {
+		return v
+	}
+	return math.Inf(1)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp // one of + - * / ^ ( ) ,
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type exprParser struct {
+	src    string
+	tokens []token
+	next   int
+	expr   *SortExpr
+}
+
+type evalFunc = func(vars *[numSortVars]float64) float64
+
+func (p *exprParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("sort expression: column %v: %v", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case unicode.IsDigit(c) || c == '.':
+			for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			// exponent, as in 1e-3
+			if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+				j := i + 1
+				if j < len(s) && (s[j] == '+' || s[j] == '-') {
+					j++
+				}
+				if j < len(s) && unicode.IsDigit(rune(s[j])) {
+					for i = j; i < len(s) && unicode.IsDigit(rune(s[i])); i++ {
+					}
+				}
+			}
+			p.tokens = append(p.tokens, token{tokNumber, s[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(s) && (unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i])) || s[i] == '_') {
+				i++
+			}
+			p.tokens = append(p.tokens, token{tokIdent, s[start:i], start})
+		case strings.ContainsRune("+-*/^(),", c):
+			i++
+			p.tokens = append(p.tokens, token{tokOp, s[start:i], start})
+		default:
+			return p.errorf(token{pos: start}, "unexpected character %q", c)
+		}
+	}
+	p.tokens = append(p.tokens, token{tokEOF, "", len(s)})
+	return nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if t := p.advance(); t.kind != tokOp || t.text != op {
+		return p.errorf(t, "expected %q but got %v", op, t)
+	}
+	return nil
+}
+
+// sum := product (('+' | '-') product)*
+func (p *exprParser) parseSum() (evalFunc, error) {
+	lhs, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.advance().text
+		rhs, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		if op == "+" {
+			lhs = func(v *[numSortVars]float64) float64 { return l(v) + rhs(v) }
+		} else {
+			lhs = func(v *[numSortVars]float64) float64 { return l(v) - rhs(v) }
+		}
+	}
+	return lhs, nil
+}
+
+// product := unary (('*' | '/') unary)*
+func (p *exprParser) parseProduct() (evalFunc, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.advance().text
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		if op == "*" {
+			lhs = func(v *[numSortVars]float64) float64 { return l(v) * rhs(v) }
+		} else {
+			lhs = func(v *[numSortVars]float64) float64 { return l(v) / rhs(v) }
+		}
+	}
+	return lhs, nil
+}
+
+// unary := '-' unary | power
+func (p *exprParser) parseUnary() (evalFunc, error) {
+	if p.isOp("-") {
+		p.advance()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v *[numSortVars]float64) float64 { return -x(v) }, nil
+	}
+	return p.parsePower()
+}
+
+// power := primary ('^' unary)?, so that 2^-1 and -2^2 = -(2^2) parse as usual
+func (p *exprParser) parsePower() (evalFunc, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("^") {
+		return base, nil
+	}
+	p.advance()
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v *[numSortVars]float64) float64 { return math.Pow(base(v), exp(v)) }, nil
+}
+
+// primary := number | variable | function '(' sum (',' sum)* ')' | '(' sum ')'
+func (p *exprParser) parsePrimary() (evalFunc, error) {
+	t := p.advance()
+	switch t.kind {
+	case tokNumber:
+		x, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.text)
+		}
+		return func(*[numSortVars]float64) float64 { return x }, nil
+	case tokIdent:
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+		for i, sv := range sortVars {
+			if sv.name == t.text {
+				p.expr.uses[i] = true
+				return func(v *[numSortVars]float64) float64 { return v[i] }, nil
+			}
+		}
+		return nil, p.errorf(t, "unknown variable %q", t.text)
+	case tokOp:
+		if t.text == "(" {
+			x, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.errorf(t, "unexpected %v", t)
+}
+
+func (p *exprParser) parseCall(name token) (evalFunc, error) {
+	f1, ok1 := sortFuncs1[name.text]
+	f2, ok2 := sortFuncs2[name.text]
+	if !ok1 && !ok2 {
+		return nil, p.errorf(name, "unknown function %q", name.text)
+	}
+	p.advance() // the opening parenthesis
+	var args []evalFunc
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isOp(",") {
+			break
+		}
+		p.advance()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	switch {
+	case ok1 && len(args) == 1:
+		x := args[0]
+		return func(v *[numSortVars]float64) float64 { return f1(x(v)) }, nil
+	case ok2 && len(args) == 2:
+		x, y := args[0], args[1]
+		return func(v *[numSortVars]float64) float64 { return f2(x(v), y(v)) }, nil
+	}
+	arity := 1
+	if ok2 {
+		arity = 2
+	}
+	return nil, p.errorf(name, "%v takes %v arguments but got %v", name.text, arity, len(args))
+}
@@ -0,0 +1,109 @@
+package pix
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCompileSortExpr(t *testing.T) {
+	var vars [numSortVars]float64
+	vars[varXY], vars[varOkL], vars[varR], vars[varHue] = 0.5, 0.25, 1, 0.75
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"2 - 3 - 4", -5},
+		{"8 / 4 / 2", 1},
+		{"-2^2", -4},
+		{"2^-1", 0.5},
+		{"2^3^2", 512},
+		{"1.5e1 + .5", 15.5},
+		{"0.6*hue + 0.3*xy - 0.1*L", 0.6*0.75 + 0.3*0.5 - 0.1*0.25},
+		{"max(r, xy) + min(r, xy)", 1.5},
+		{"mod(hue + 0.5, 1)", 0.25},
+		{"mod(-0.25, 1)", 0.75},
+		{"abs(-3) + sqrt(4) + floor(2.5)", 7},
+	}
+	for _, test := range tests {
+		e, err := CompileSortExpr(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.src, err)
+			continue
+		}
+		if got := e.eval(&vars); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%q: got %v; want %v", test.src, got, test.want)
+		}
+	}
+
+	errors := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"foo",
+		"foo(1)",
+		"min(1)",
+		"abs(1, 2)",
+		"1 $ 2",
+		"1..2",
+	}
+	for _, src := range errors {
+		if _, err := CompileSortExpr(src); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestSortByExpr(t *testing.T) {
+	var colors []SampledColor
+	for i, v := range []uint16{200, 50, 255, 0, 128} {
+		colors = append(colors, sampleColor(ImageColor{4 - i, 0, v * 0x101, 0, 0}, uint32(i), SampleOptions{}))
+	}
+	// sort by red, and then by source x position, which runs opposite to the xy code
+	for _, test := range []struct {
+		src  string
+		less func(a, b SampledColor) bool
+	}{
+		{"r", func(a, b SampledColor) bool { return a.rgb.x < b.rgb.x }},
+		{"x - 0*xy", func(a, b SampledColor) bool { return a.x < b.x }},
+		{"-xy", func(a, b SampledColor) bool { return a.xyCode > b.xyCode }},
+	} {
+		e, err := CompileSortExpr(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SortBySimilarity(colors, SortOptions{Expr: e})
+		for i := 1; i < len(colors); i++ {
+			if test.less(colors[i], colors[i-1]) {
+				t.Errorf("%q: colors are out of order: %v", test.src, colors)
+				break
+			}
+		}
+	}
+}
+
+func TestSortByExprNaN(t *testing.T) {
+	var colors []SampledColor
+	for i, v := range []uint16{200, 50, 255, 0, 128, 100} {
+		colors = append(colors, sampleColor(ImageColor{i, 0, v * 0x101, 0, 0}, uint32(i), SampleOptions{}))
+	}
+	// the square root is NaN for colors with r < 0.4, which sort last
+	e, err := CompileSortExpr("sqrt(r - 0.4)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SortBySimilarity(colors, SortOptions{Expr: e})
+	want := []uint16{128, 200, 255}
+	for i, v := range want {
+		if colors[i].rgb.x != v {
+			t.Fatalf("colors are out of order: %v", colors)
+		}
+	}
+	for _, c := range colors[len(want):] {
+		if c.rgb.x >= 0.4*255 {
+			t.Fatalf("colors are out of order: %v", colors)
+		}
+	}
+}
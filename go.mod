@@ -1,3 +1,5 @@
 module github.com/yurivish/pix
 
 go 1.17
+
+require golang.org/x/image v0.12.0
@@ -56,7 +56,7 @@ func hilbertToMorton3D(hilbertIndex, bits uint32) uint32 {
 }
 
 func hilbertCode(x, y, z uint8) uint32 {
-	return mortonToHilbert3D(uint32(mortonCode(x, y, z)), 8)
+	return mortonToHilbert3D(uint32(mortonCode(uint16(x), uint16(y), uint16(z))), 8)
 }
 
 func prefixScan(x uint32) uint32 {
@@ -1,65 +1,170 @@
 package pix
 
 import (
+	"bytes"
 	"fmt"
 	"image"
 	"image/draw"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"os"
-	"path"
+
+	// register decoders for image.Decode, which picks among them
+	// by sniffing the magic bytes at the start of the file.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
 )
 
+type LoadOptions struct {
+	// Pixels with an alpha value below AlphaThreshold are skipped, so that transparent
+	// regions don't contribute to the palette. The zero value keeps every pixel.
+	AlphaThreshold uint8
+	// Keep 16 bits per channel from high bit-depth sources rather than
+	// reducing them to 8 bits. See SampleOptions.HighPrecision.
+	HighPrecision bool
+	// Ignore the EXIF orientation of JPEG sources rather than rotating
+	// and flipping them upright before computing pixel positions.
+	IgnoreOrientation bool
+	// If non-empty, only pixels within Crop are loaded. Their positions are
+	// unchanged, so Crop is given in the coordinates of the (upright) image.
+	Crop image.Rectangle
+}
+
 // Returns `ImageColor`s from the source in row major order.
-func LoadImage(path string) ([]ImageColor, error) {
-	img, err := loadRGBA(path)
+func LoadImage(path string, opts LoadOptions) ([]ImageColor, error) {
+	img, err := loadRGBA(path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error loading image: %w", err)
+	}
+	return imageColors(img, opts)
+}
+
+// Returns `ImageColor`s from the encoded image read from r in row major order.
+func LoadImageFrom(r io.Reader, opts LoadOptions) ([]ImageColor, error) {
+	img, err := decodeRGBA(r, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error loading image: %w", err)
 	}
-	sz := img.Bounds().Max
-	index := 0
-	colors := make([]ImageColor, sz.X*sz.Y)
-	pix, stride := img.Pix, img.Stride
-	for y := 0; y < sz.Y; y++ {
-		for x := 0; x < sz.X; x++ {
-			i := y*stride + x*4
-			r, g, b := pix[i], pix[i+1], pix[i+2]
-			colors[index] = ImageColor{x, y, r, g, b}
-			index++
+	return imageColors(img, opts)
+}
+
+// img must be an *image.RGBA or *image.RGBA64 with its origin at (0, 0)
+func imageColors(img image.Image, opts LoadOptions) ([]ImageColor, error) {
+	bounds := img.Bounds()
+	if !opts.Crop.Empty() {
+		bounds = bounds.Intersect(opts.Crop)
+	}
+	colors := make([]ImageColor, 0, bounds.Dx()*bounds.Dy())
+	switch img := img.(type) {
+	case *image.RGBA:
+		pix, stride := img.Pix, img.Stride
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := y*stride + x*4
+				r, g, b, a := pix[i], pix[i+1], pix[i+2], pix[i+3]
+				if a < opts.AlphaThreshold {
+					continue
+				}
+				if a > 0 && a < 255 {
+					// RGBA is alpha-premultiplied; recover the unpremultiplied color
+					r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+				}
+				// scale to 16 bits such that the high byte holds the 8-bit value
+				colors = append(colors, ImageColor{x, y, uint16(r) * 0x101, uint16(g) * 0x101, uint16(b) * 0x101})
+			}
+		}
+	case *image.RGBA64:
+		pix, stride := img.Pix, img.Stride
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := y*stride + x*8
+				r := uint16(pix[i])<<8 | uint16(pix[i+1])
+				g := uint16(pix[i+2])<<8 | uint16(pix[i+3])
+				b := uint16(pix[i+4])<<8 | uint16(pix[i+5])
+				a := uint16(pix[i+6])<<8 | uint16(pix[i+7])
+				if uint8(a>>8) < opts.AlphaThreshold {
+					continue
+				}
+				if a > 0 && a < 0xffff {
+					r, g, b = unpremultiply16(r, a), unpremultiply16(g, a), unpremultiply16(b, a)
+				}
+				colors = append(colors, ImageColor{x, y, r, g, b})
+			}
+		}
+	default:
+		panic("imageColors: unsupported image type")
+	}
+	if len(colors) == 0 {
+		if !opts.Crop.Empty() {
+			return nil, fmt.Errorf("no pixels with alpha of at least %v within %v", opts.AlphaThreshold, opts.Crop)
 		}
+		return nil, fmt.Errorf("no pixels with alpha of at least %v in the image", opts.AlphaThreshold)
 	}
 	return colors, nil
 }
 
+func unpremultiply(x, a uint8) uint8 {
+	return uint8((uint32(x)*255 + uint32(a)/2) / uint32(a))
+}
+
+func unpremultiply16(x, a uint16) uint16 {
+	return uint16((uint32(x)*0xffff + uint32(a)/2) / uint32(a))
+}
+
+// ImageColor is a source pixel with 16-bit sRGB components. Colors
+// from 8-bit sources are scaled so that the high byte holds the 8-bit value.
 type ImageColor struct {
 	X, Y    int
-	R, G, B uint8
+	R, G, B uint16
 }
 
-func loadRGBA(filepath string) (*image.RGBA, error) {
+// Returns an *image.RGBA, or an *image.RGBA64 in high-precision mode.
+func loadRGBA(filepath string, opts LoadOptions) (image.Image, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("error opening file: %w", err)
 	}
 	defer f.Close()
-	var img image.Image
-	ext := path.Ext(filepath)
-	if ext == ".png" {
-		img, err = png.Decode(f)
-	} else if ext == ".jpg" || ext == ".jpeg" {
-		img, err = jpeg.Decode(f)
-	} else {
-		return nil, fmt.Errorf("unknown image extension (we understand .png, .jpg, .jpeg): %v", ext)
-	}
+	return decodeRGBA(f, opts)
+}
+
+func decodeRGBA(r io.Reader, opts LoadOptions) (image.Image, error) {
+	// read everything up front so we can look for EXIF metadata after decoding
+	data, err := io.ReadAll(r)
 	if err != nil {
+		return nil, fmt.Errorf("error reading image: %w", err)
+	}
+	// the format is detected from the file contents rather than its extension
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, fmt.Errorf("unknown image format (we understand png, jpeg, gif, bmp, tiff, pgm, ppm): %w", err)
+	} else if err != nil {
 		return nil, fmt.Errorf("error decoding image: %w", err)
 	}
-	if rgba, ok := img.(*image.RGBA); ok {
-		return rgba, nil
-	} else {
-		b := img.Bounds()
-		rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	rgba := toRGBA(img, opts.HighPrecision)
+	if format == "jpeg" && !opts.IgnoreOrientation {
+		rgba = applyOrientation(rgba, jpegOrientation(data))
+	}
+	return rgba, nil
+}
+
+func toRGBA(img image.Image, highPrecision bool) image.Image {
+	b := img.Bounds()
+	if highPrecision {
+		if rgba, ok := img.(*image.RGBA64); ok && b.Min == (image.Point{}) {
+			return rgba
+		}
+		rgba := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
 		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
-		return rgba, nil
+		return rgba
+	}
+	if rgba, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
 	}
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
 }
@@ -0,0 +1,44 @@
+package pix
+
+import (
+	"image"
+	"testing"
+)
+
+func TestImageColorsAlphaThreshold(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	copy(img.Pix, []uint8{
+		10, 20, 30, 255, // opaque
+		0, 0, 0, 0, // fully transparent
+		50, 25, 0, 128, // half-transparent, premultiplied
+	})
+	tests := []struct {
+		threshold uint8
+		want      []ImageColor
+	}{
+		{0, []ImageColor{{0, 0, 10 * 0x101, 20 * 0x101, 30 * 0x101}, {1, 0, 0, 0, 0}, {2, 0, 100 * 0x101, 50 * 0x101, 0}}},
+		{1, []ImageColor{{0, 0, 10 * 0x101, 20 * 0x101, 30 * 0x101}, {2, 0, 100 * 0x101, 50 * 0x101, 0}}},
+		{255, []ImageColor{{0, 0, 10 * 0x101, 20 * 0x101, 30 * 0x101}}},
+	}
+	for _, test := range tests {
+		got, err := imageColors(img, LoadOptions{AlphaThreshold: test.threshold})
+		if err != nil {
+			t.Errorf("threshold %v: unexpected error: %v", test.threshold, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("threshold %v: got %v; want %v", test.threshold, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("threshold %v: got %v; want %v", test.threshold, got, test.want)
+				break
+			}
+		}
+	}
+
+	if _, err := imageColors(image.NewRGBA(image.Rect(0, 0, 1, 1)), LoadOptions{AlphaThreshold: 1}); err == nil {
+		t.Errorf("expected an error for a fully transparent image")
+	}
+}
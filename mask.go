@@ -0,0 +1,66 @@
+package pix
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// A Mask gives each pixel of a source image an inclusion weight between
+// 0 and 1, taken from the luminance of a grayscale image of the same size.
+// Pixels with zero weight are excluded from sampling, and the rest are sampled
+// with probability proportional to their weight. Transparent mask pixels
+// count as black.
+type Mask struct {
+	w, h int
+	gray []uint16 // row-major 16-bit luminance
+}
+
+// Returns a mask built from the luminance of img, whose top-left
+// corner is aligned with the top-left corner of the source image.
+func NewMask(img image.Image) *Mask {
+	b := img.Bounds()
+	m := &Mask{b.Dx(), b.Dy(), make([]uint16, b.Dx()*b.Dy())}
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// the color is alpha-premultiplied, which scales the weight by alpha
+			r, g, bl, _ := img.At(x, y).RGBA()
+			m.gray[i] = uint16((19595*r + 38470*g + 7471*bl + 1<<15) >> 16)
+			i++
+		}
+	}
+	return m
+}
+
+// Loads a mask image. As with LoadImage, JPEG masks are rotated upright
+// unless ignoreOrientation is set, so that they line up with their source.
+func LoadMask(path string, ignoreOrientation bool) (*Mask, error) {
+	img, err := loadRGBA(path, LoadOptions{HighPrecision: true, IgnoreOrientation: ignoreOrientation})
+	if err != nil {
+		return nil, fmt.Errorf("error loading mask: %w", err)
+	}
+	return NewMask(img), nil
+}
+
+// Loads a mask from the encoded image read from r; see LoadMask.
+func LoadMaskFrom(r io.Reader, ignoreOrientation bool) (*Mask, error) {
+	img, err := decodeRGBA(r, LoadOptions{HighPrecision: true, IgnoreOrientation: ignoreOrientation})
+	if err != nil {
+		return nil, fmt.Errorf("error loading mask: %w", err)
+	}
+	return NewMask(img), nil
+}
+
+// Returns the weight of the pixel at (x, y), which is zero outside the mask.
+func (m *Mask) Weight(x, y int) float64 {
+	if x < 0 || y < 0 || x >= m.w || y >= m.h {
+		return 0
+	}
+	return float64(m.gray[y*m.w+x]) / 0xffff
+}
+
+// Returns the mask's width and height.
+func (m *Mask) Size() (int, int) {
+	return m.w, m.h
+}
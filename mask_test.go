@@ -0,0 +1,97 @@
+package pix
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestCrop(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	crop := image.Rect(1, 2, 3, 5)
+	colors, err := LoadImageFrom(bytes.NewReader(buf.Bytes()), LoadOptions{Crop: crop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the crop is clipped to the image, and pixels keep their positions
+	if len(colors) != 4 {
+		t.Errorf("got %v pixels; want 4", len(colors))
+	}
+	for _, c := range colors {
+		if !image.Pt(c.X, c.Y).In(crop) {
+			t.Errorf("pixel at (%v, %v) lies outside the crop %v", c.X, c.Y, crop)
+		}
+	}
+	if _, err := LoadImageFrom(bytes.NewReader(buf.Bytes()), LoadOptions{Crop: image.Rect(4, 4, 8, 8)}); err == nil {
+		t.Errorf("expected an error for a crop outside the image")
+	}
+}
+
+func TestMask(t *testing.T) {
+	// an 8x8 source that is black on the left and white on the right
+	var src []ImageColor
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			v := uint16(0)
+			if x >= 4 {
+				v = 0xffff
+			}
+			src = append(src, ImageColor{x, y, v, v, v})
+		}
+	}
+
+	// masking out the left half samples the right half as if it had been cropped,
+	// with xy codes computed relative to the selected region
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 4; x < 8; x++ {
+			gray.SetGray(x, y, color.Gray{255})
+		}
+	}
+	got := mustSampleColors(t, src, 64, SampleOptions{Mask: NewMask(gray)})
+	var cropped []ImageColor
+	for _, c := range src {
+		if c.X >= 4 {
+			cropped = append(cropped, c)
+		}
+	}
+	want := mustSampleColors(t, cropped, 64, SampleOptions{})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("masked: got %v; want %v", got, want)
+		}
+	}
+
+	// pixels are sampled in proportion to their weights
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			gray.SetGray(x, y, color.Gray{85}) // one third
+		}
+	}
+	for _, strategy := range []Strategy{StrategyRowMajor, StrategyStratified, StrategyRandom, StrategyAreaAverage} {
+		for _, n := range []int{32, 256} {
+			colors := mustSampleColors(t, src, n, SampleOptions{Mask: NewMask(gray), Strategy: strategy, Seed: 1})
+			nBlack := 0
+			for _, c := range colors {
+				if c.rgb.x == 0 {
+					nBlack++
+				}
+			}
+			if want := n / 4; nBlack < want-2 || nBlack > want+2 {
+				t.Errorf("strategy %v, %v colors: got %v black colors; want about %v", strategy, n, nBlack, want)
+			}
+		}
+	}
+
+	// masks must cover their sources
+	small := NewMask(image.NewGray(image.Rect(0, 0, 4, 4)))
+	if _, err := SampleSources([]Source{{src, 1, small}}, 16, SampleOptions{}); err == nil {
+		t.Errorf("expected an error for a mask smaller than its source")
+	}
+}
@@ -24,13 +24,13 @@ func spread2(x uint32) MortonCode {
   return MortonCode(x)
 }
 
-func mortonCode(x, y, z uint8) MortonCode {
+func mortonCode(x, y, z uint16) MortonCode {
   return (spread2(uint32(z)) << 2) + (spread2(uint32(y)) << 1) + spread2(uint32(x))
 }
 
-func mortonX(code MortonCode) uint8 { return uint8(smoosh2(code >> 0)) }
-func mortonY(code MortonCode) uint8 { return uint8(smoosh2(code >> 1)) }
-func mortonZ(code MortonCode) uint8 { return uint8(smoosh2(code >> 2)) }
+func mortonX(code MortonCode) uint16 { return uint16(smoosh2(code >> 0)) }
+func mortonY(code MortonCode) uint16 { return uint16(smoosh2(code >> 1)) }
+func mortonZ(code MortonCode) uint16 { return uint16(smoosh2(code >> 2)) }
 
 // Each mask contains 0 in the slot for its component, and 1s elsewhere,
 // assuming 10 bits per number and filling in the high 2 bits with 1 to be safe.
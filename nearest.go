@@ -1,13 +1,16 @@
 package pix
 
 import (
+	"math"
 	"math/bits"
 )
 
 // This file holds supporting functions for nearest-neighbor search.
 // See ziptree.go for the actual search implementation.
 
-func distSqToBBox(q, a, b MortonCode, qColor Color) uint32 { // takes morton codes as arguments
+// Returns the weighted squared distance from qColor to the bounding box of the
+// morton codes a and b, which bounds the distance to every color in the box.
+func distSqToBBox(q, a, b MortonCode, qColor Color, w axisWeights) uint64 { // takes morton codes as arguments
 	// use the code representation to compute the binary bbox
 	// get the most significant differing bit between the morton codes a and b
 	msb := bits.Len32(uint32(a ^ b))
@@ -21,42 +24,80 @@ func distSqToBBox(q, a, b MortonCode, qColor Color) uint32 { // takes morton cod
 	hi := lo + (1 << msb) - 1
 
 	// accumulate squared distance to the bounding box
-	dSq := uint32(0)
+	dSq := uint64(0)
 
 	// x coordinate
 	if ltMortonX(q, lo) {
-		dSq += sqDiff(qColor.x, mortonX(lo))
+		dSq += uint64(w[0]) * uint64(sqDiff(qColor.x, mortonX(lo)))
 	} else if gtMortonX(q, hi) {
-		dSq += sqDiff(qColor.x, mortonX(hi))
+		dSq += uint64(w[0]) * uint64(sqDiff(qColor.x, mortonX(hi)))
 	}
 
 	// y coordinate
 	if ltMortonY(q, lo) {
-		dSq += sqDiff(qColor.y, mortonY(lo))
+		dSq += uint64(w[1]) * uint64(sqDiff(qColor.y, mortonY(lo)))
 	} else if gtMortonY(q, hi) {
-		dSq += sqDiff(qColor.y, mortonY(hi))
+		dSq += uint64(w[1]) * uint64(sqDiff(qColor.y, mortonY(hi)))
 	}
 
 	// z coordinate
 	if ltMortonZ(q, lo) {
-		dSq += sqDiff(qColor.z, mortonZ(lo))
+		dSq += uint64(w[2]) * uint64(sqDiff(qColor.z, mortonZ(lo)))
 	} else if gtMortonZ(q, hi) {
-		dSq += sqDiff(qColor.z, mortonZ(hi))
+		dSq += uint64(w[2]) * uint64(sqDiff(qColor.z, mortonZ(hi)))
 	}
 	return dSq
 }
 
-// saturating 8-bit addition
-func satAdd(a, b uint8) uint8 {
-	r := a + b
-	if r < a {
-		return 255
+// Integer weights for the squared differences along the x, y and z axes of
+// the distance metric. Equal weights give the same nearest neighbors as
+// unweighted distances, ties included.
+type axisWeights [3]uint32
+
+var unitWeights = axisWeights{1, 1, 1}
+
+// The fixed-point scale of the largest weight
+const axisWeightScale = 1 << 16
+
+// Converts relative axis weights to integers, scaling the largest to
+// axisWeightScale. The zero value, as a shorthand for equal weights,
+// gives unitWeights. The weights must be nonnegative.
+func newAxisWeights(weights [3]float64) axisWeights {
+	largest := math.Max(weights[0], math.Max(weights[1], weights[2]))
+	if largest == 0 {
+		return unitWeights
+	}
+	var w axisWeights
+	for i, x := range weights {
+		w[i] = uint32(math.Round(axisWeightScale * x / largest))
+	}
+	return w
+}
+
+// Returns the largest difference along each axis between q and a color within
+// weighted squared distance rSq of it, at most max. A zero-weight axis does
+// not bound the difference.
+func (w axisWeights) radii(rSq uint64, max uint16) (r [3]uint16) {
+	for i, wi := range w {
+		if wi == 0 || rSq >= uint64(wi)*uint64(max)*uint64(max) {
+			r[i] = max
+		} else {
+			r[i] = uint16(math.Ceil(math.Sqrt(float64(rSq) / float64(wi))))
+		}
 	}
 	return r
 }
 
-// saturating 8-bit subtraction
-func satSub(a, b uint8) uint8 {
+// addition saturating at max
+func satAdd(a, b, max uint16) uint16 {
+	if b > max-a {
+		return max
+	}
+	return a + b
+}
+
+// saturating subtraction
+func satSub(a, b uint16) uint16 {
 	if b > a {
 		return 0
 	}
@@ -67,7 +108,24 @@ func sqDist(a, b Color) uint32 {
 	return sqDiff(a.x, b.x) + sqDiff(a.y, b.y) + sqDiff(a.z, b.z)
 }
 
-func sqDiff(x uint8, y uint8) uint32 {
+// the largest of the weights, by which a squared distance along the most
+// heavily weighted axis is scaled
+func (w axisWeights) max() uint64 {
+	m := w[0]
+	if w[1] > m {
+		m = w[1]
+	}
+	if w[2] > m {
+		m = w[2]
+	}
+	return uint64(m)
+}
+
+func weightedSqDist(a, b Color, w axisWeights) uint64 {
+	return uint64(w[0])*uint64(sqDiff(a.x, b.x)) + uint64(w[1])*uint64(sqDiff(a.y, b.y)) + uint64(w[2])*uint64(sqDiff(a.z, b.z))
+}
+
+func sqDiff(x uint16, y uint16) uint32 {
 	diff := uint32(x) - uint32(y)
 	return diff * diff
 }
@@ -1,6 +1,11 @@
 package pix
 
-import "testing"
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
 
 func TestDistSqToBBox(t *testing.T) {
 	colorToMortonCode := func(color Color) MortonCode {
@@ -20,8 +25,8 @@ func TestDistSqToBBox(t *testing.T) {
 	}
 	for _, test := range tests {
 		q, a, b := colorToMortonCode(test.q), colorToMortonCode(test.a), colorToMortonCode(test.b)
-		got := distSqToBBox(q, a, b, test.q)
-		if got != test.result {
+		got := distSqToBBox(q, a, b, test.q, unitWeights)
+		if got != uint64(test.result) {
 			t.Errorf("%v: got %v; want %v", test, got, test.result)
 		}
 	}
@@ -29,11 +34,12 @@ func TestDistSqToBBox(t *testing.T) {
 
 func TestSatAdd(t *testing.T) {
 	tests := []struct {
-		a, b, c uint8
-	}{{0, 0, 0}, {1, 1, 2}, {255, 0, 255}, {255, 1, 255}, {1, 255, 255},
-		{100, 155, 255}, {200, 200, 255}, {255, 255, 255}, {128, 128, 255}}
+		a, b, max, c uint16
+	}{{0, 0, 255, 0}, {1, 1, 255, 2}, {255, 0, 255, 255}, {255, 1, 255, 255}, {1, 255, 255, 255},
+		{100, 155, 255, 255}, {200, 200, 255, 255}, {255, 255, 255, 255}, {128, 128, 255, 255},
+		{255, 1, 1023, 256}, {1000, 23, 1023, 1023}, {1000, 1000, 1023, 1023}, {1023, 1023, 1023, 1023}}
 	for _, test := range tests {
-		got := satAdd(test.a, test.b)
+		got := satAdd(test.a, test.b, test.max)
 		if got != test.c {
 			t.Errorf("%v: got %v; want %v", test, got, test.c)
 		}
@@ -42,9 +48,9 @@ func TestSatAdd(t *testing.T) {
 
 func TestSatSub(t *testing.T) {
 	tests := []struct {
-		a, b, c uint8
+		a, b, c uint16
 	}{{0, 0, 0}, {0, 1, 0}, {1, 0, 1}, {255, 254, 1}, {254, 255, 0},
-		{100, 155, 0}, {200, 100, 100}, {0, 100, 0}, {10, 10, 0}}
+		{100, 155, 0}, {200, 100, 100}, {0, 100, 0}, {10, 10, 0}, {1023, 1, 1022}}
 	for _, test := range tests {
 		got := satSub(test.a, test.b)
 		if got != test.c {
@@ -63,6 +69,7 @@ func TestSqDist(t *testing.T) {
 		{Color{0, 2, 0}, Color{0, 0, 0}, 4},
 		{Color{0, 0, 2}, Color{0, 0, 0}, 4},
 		{Color{255, 255, 255}, Color{1, 1, 1}, 254 * 254 * 3},
+		{Color{1023, 1023, 1023}, Color{0, 0, 0}, 1023 * 1023 * 3},
 	}
 	for _, test := range tests {
 		got := sqDist(test.a, test.b)
@@ -78,10 +85,11 @@ func TestSqDist(t *testing.T) {
 
 func TestSqDiff(t *testing.T) {
 	tests := []struct {
-		a, b uint8
+		a, b uint16
 		c    uint32
 	}{{0, 0, 0}, {1, 1, 0}, {2, 1, 1}, {1, 2, 1}, {2, 0, 4}, {0, 2, 4},
-		{255, 0, 255 * 255}, {128, 255, 127 * 127}, {255, 128, 127 * 127}}
+		{255, 0, 255 * 255}, {128, 255, 127 * 127}, {255, 128, 127 * 127},
+		{1023, 0, 1023 * 1023}, {0, 1023, 1023 * 1023}}
 	for _, test := range tests {
 		got := sqDiff(test.a, test.b)
 		if got != test.c {
@@ -89,3 +97,90 @@ func TestSqDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, weights := range [][3]float64{{}, {1, 1, 1}, {4, 1, 1}, {1, 0.1, 0.1}, {0, 1, 2}, {1, 0, 0}, {1e-6, 1, 1}} {
+		w := newAxisWeights(weights)
+		for _, max := range []uint16{max8, max10} {
+			tree := newZipTree(rng, max, w)
+			var colors []Color
+			codes := map[MortonCode]bool{}
+			for len(colors) < 500 {
+				c := Color{uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1))}
+				if code := mortonCode(c.x, c.y, c.z); !codes[code] {
+					codes[code] = true
+					colors = append(colors, c)
+					tree.Insert(code)
+				}
+			}
+			for i := 0; i < 500; i++ {
+				q := Color{uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1))}
+				want := uint64(math.MaxUint64)
+				for _, c := range colors {
+					if d := weightedSqDist(q, c, w); d < want {
+						want = d
+					}
+				}
+				got := tree.Nearest(q, mortonCode(q.x, q.y, q.z))
+				if d := weightedSqDist(q, mortonCodeToColor(got), w); d != want {
+					t.Fatalf("weights %v, max %v: nearest to %v is %v at distance %v; want distance %v",
+						weights, max, q, mortonCodeToColor(got), d, want)
+				}
+			}
+		}
+	}
+}
+
+func TestNearestK(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, weights := range [][3]float64{{}, {4, 1, 1}, {0, 1, 2}} {
+		w := newAxisWeights(weights)
+		for _, max := range []uint16{max8, max10} {
+			tree := newZipTree(rng, max, w)
+			var colors []Color
+			codes := map[MortonCode]bool{}
+			for len(colors) < 500 {
+				c := Color{uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1))}
+				if code := mortonCode(c.x, c.y, c.z); !codes[code] {
+					codes[code] = true
+					colors = append(colors, c)
+					tree.Insert(code)
+				}
+			}
+			for _, k := range []int{1, 2, 8, 500, 600} {
+				for i := 0; i < 100; i++ {
+					q := colors[rng.Intn(len(colors))] // queries that are in the tree
+					if i%2 == 1 {
+						q = Color{uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1)), uint16(rng.Intn(int(max) + 1))}
+					}
+					qCode := mortonCode(q.x, q.y, q.z)
+					dists := make([]uint64, len(colors))
+					for j, c := range colors {
+						dists[j] = weightedSqDist(q, c, w)
+					}
+					sort.Slice(dists, func(i, j int) bool { return dists[i] < dists[j] })
+					want := k
+					if want > len(dists) {
+						want = len(dists)
+					}
+					got := tree.NearestK(q, qCode, k, nil)
+					if len(got) != want {
+						t.Fatalf("weights %v, max %v, k %v: got %v candidates; want %v", weights, max, k, len(got), want)
+					}
+					for j, code := range got {
+						if d := weightedSqDist(q, mortonCodeToColor(code), w); d != dists[j] {
+							t.Fatalf("weights %v, max %v, k %v: candidate %v of %v is at distance %v; want %v",
+								weights, max, k, j, q, d, dists[j])
+						}
+					}
+					if k == 1 {
+						if d := weightedSqDist(q, mortonCodeToColor(tree.Nearest(q, qCode)), w); d != dists[0] {
+							t.Fatalf("weights %v, max %v: Nearest found distance %v; want %v", weights, max, d, dists[0])
+						}
+					}
+				}
+			}
+		}
+	}
+}
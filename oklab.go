@@ -0,0 +1,170 @@
+package pix
+
+import (
+	"fmt"
+	"math"
+)
+
+// An OkLabTransform is an affine map from OkLab coordinates to [0, 1] used to
+// quantize colors in place of the fixed range spanning the whole sRGB gamut,
+// which leaves most codes unused for muted sources. Fitting the transform
+// to a palette spreads its colors over the full range of codes, so that
+// fewer distinct colors share a code and tie in nearest-neighbor searches.
+//
+// A nil *OkLabTransform stands for the fixed range. The same transform
+// must be used to sample colors (SampleOptions.OkLab) and to place them
+// (Options.OkLab), since the canvas inverts it to recover sRGB output;
+// Place returns an error if they evidently differ.
+type OkLabTransform struct {
+	lo    [3]float64 // the smallest L, a and b coordinates
+	scale [3]float64 // the extent by which each coordinate is divided after subtracting lo
+}
+
+// quantize OkLab coordinates to integers in [0, max], clamping those outside the transform's range
+func (t *OkLabTransform) quantize(L, a, b float64, max uint16) Color {
+	if t == nil {
+		return quantizeOkLab(L, a, b, max)
+	}
+	return Color{
+		quantize(clamp((L-t.lo[0])/t.scale[0], 0, 1), max),
+		quantize(clamp((a-t.lo[1])/t.scale[1], 0, 1), max),
+		quantize(clamp((b-t.lo[2])/t.scale[2], 0, 1), max)}
+}
+
+// remap a quantized OkLab code to OkLab coordinates
+func (t *OkLabTransform) dequantize(code MortonCode, max uint16) (L, a, b float64) {
+	if t == nil {
+		return invQuantize(mortonX(code), max), invQuantize(mortonY(code), max) + aLo, invQuantize(mortonZ(code), max) + bLo
+	}
+	return invRemap(invQuantize(mortonX(code), max), t.lo[0], t.lo[0]+t.scale[0]),
+		invRemap(invQuantize(mortonY(code), max), t.lo[1], t.lo[1]+t.scale[1]),
+		invRemap(invQuantize(mortonZ(code), max), t.lo[2], t.lo[2]+t.scale[2])
+}
+
+// Returns the transform that maps the bounding box [lo, hi] of a set of colors
+// into [0, 1]. An isotropic transform scales every coordinate by the largest
+// extent, which keeps distances between codes proportional to OkLab distances.
+// An anisotropic one stretches each coordinate to fill the range, which
+// emphasizes the differences along the narrower axes, such as the chroma
+// axes of a muted photo, in nearest-neighbor searches.
+func newOkLabTransform(lo, hi [3]float64, anisotropic bool) *OkLabTransform {
+	t := &OkLabTransform{lo: lo}
+	var largest float64
+	for i := range lo {
+		t.scale[i] = hi[i] - lo[i]
+		if t.scale[i] > largest {
+			largest = t.scale[i]
+		}
+	}
+	for i := range t.scale {
+		if !anisotropic {
+			t.scale[i] = largest
+		}
+		if !(t.scale[i] > 0) {
+			// all colors share the coordinate
+			t.scale[i] = 1
+		}
+	}
+	return t
+}
+
+// Returns the tightest transform for the OkLab colors of the sources' pixels
+// with nonzero mask weight, computed at the precision given by opts.HighPrecision,
+// or nil if there are no such pixels. Sampled colors, including averaged ones,
+// lie within the range of the source colors.
+func FitOkLab(srcs []Source, opts SampleOptions, anisotropic bool) *OkLabTransform {
+	// linearize through a table, since the sources may have many pixels
+	shift, max := uint(8), uint16(max8)
+	if opts.HighPrecision {
+		shift, max = 0, 0xffff
+	}
+	lin := make([]float64, int(max)+1)
+	for i := range lin {
+		lin[i] = toLinearRGB(uint16(i), max)
+	}
+	b := newLabBounds()
+	for _, src := range srcs {
+		for _, c := range src.Colors {
+			if src.Mask != nil && src.Mask.Weight(c.X, c.Y) == 0 {
+				continue
+			}
+			b.add(linear_srgb_to_oklab(lin[c.R>>shift], lin[c.G>>shift], lin[c.B>>shift]))
+		}
+	}
+	return b.transform(anisotropic)
+}
+
+// Returns the tightest transform for the OkLab colors of the palette, which
+// also covers gradients through them, or nil if the palette is empty.
+func FitOkLabPalette(palette []PaletteColor, anisotropic bool) *OkLabTransform {
+	b := newLabBounds()
+	for _, c := range palette {
+		b.add(linear_srgb_to_oklab(
+			toLinearRGB(uint16(c.R), max8),
+			toLinearRGB(uint16(c.G), max8),
+			toLinearRGB(uint16(c.B), max8)))
+	}
+	return b.transform(anisotropic)
+}
+
+// The bounding box of a set of OkLab colors
+type labBounds struct {
+	lo, hi [3]float64
+	n      int
+}
+
+func newLabBounds() *labBounds {
+	inf := math.Inf(1)
+	return &labBounds{lo: [3]float64{inf, inf, inf}, hi: [3]float64{-inf, -inf, -inf}}
+}
+
+func (b *labBounds) add(L, A, B float64) {
+	for i, v := range [3]float64{L, A, B} {
+		if v < b.lo[i] {
+			b.lo[i] = v
+		}
+		if v > b.hi[i] {
+			b.hi[i] = v
+		}
+	}
+	b.n++
+}
+
+func (b *labBounds) transform(anisotropic bool) *OkLabTransform {
+	if b.n == 0 {
+		return nil
+	}
+	return newOkLabTransform(b.lo, b.hi, anisotropic)
+}
+
+// The largest mean difference per channel, in 8-bit sRGB levels, between colors
+// and their decoded OkLab codes that we attribute to quantization. Decoding with
+// the transform the codes were quantized with gives differences of about one
+// level, and decoding with another gives differences of tens of levels.
+const okLabMismatch = 4
+
+// Returns an error if the colors' OkLab codes were evidently quantized with a
+// transform other than t, checking a spread of at most a few thousand colors.
+// Transforms close enough to pass give nearly the same output.
+func checkOkLab(colors []SampledColor, t *OkLabTransform, max uint16) error {
+	step := len(colors)/4096 + 1
+	var sum, n int
+	for i := 0; i < len(colors); i += step {
+		x := colors[i]
+		r, g, b := okLabCodeToLinearRgb(x.labCode, max, t)
+		sum += absDiff(toNonlinearRGBLUT(r), x.rgb.x) + absDiff(toNonlinearRGBLUT(g), x.rgb.y) + absDiff(toNonlinearRGBLUT(b), x.rgb.z)
+		n += 3
+	}
+	if n > 0 && sum > okLabMismatch*n {
+		return fmt.Errorf("the colors' OkLab codes do not match the OkLab transform; sample and place colors with the same transform")
+	}
+	return nil
+}
+
+func absDiff(a uint8, b uint16) int {
+	d := int(a) - int(b)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
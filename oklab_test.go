@@ -0,0 +1,78 @@
+package pix
+
+import "testing"
+
+func TestFitOkLab(t *testing.T) {
+	// a muted source: grayish blues that occupy a small corner of OkLab
+	var src []ImageColor
+	for i := 0; i < 64; i++ {
+		v := uint16(100 + i)
+		src = append(src, ImageColor{i, 0, v * 0x101, (v + 5) * 0x101, (v + 20) * 0x101})
+	}
+	srcs := []Source{{src, 1, nil}}
+
+	distinct := func(colors []SampledColor) int {
+		codes := map[MortonCode]bool{}
+		for _, c := range colors {
+			codes[c.labCode] = true
+		}
+		return len(codes)
+	}
+	fixed := mustSampleColors(t, src, len(src), SampleOptions{})
+	for _, anisotropic := range []bool{false, true} {
+		opts := SampleOptions{OkLab: FitOkLab(srcs, SampleOptions{}, anisotropic)}
+		fitted := mustSampleColors(t, src, len(src), opts)
+		if distinct(fitted) <= distinct(fixed) {
+			t.Errorf("anisotropic %v: fitted quantization gives %v distinct codes; the fixed range gives %v", anisotropic, distinct(fitted), distinct(fixed))
+		}
+
+		// the fitted range spans the codes along the widest axis, and every axis if anisotropic
+		var lo, hi [3]uint16
+		lo = [3]uint16{max8, max8, max8}
+		for _, c := range fitted {
+			for i, v := range [3]uint16{c.lab.x, c.lab.y, c.lab.z} {
+				if v < lo[i] {
+					lo[i] = v
+				}
+				if v > hi[i] {
+					hi[i] = v
+				}
+			}
+		}
+		full := 0
+		for i := range lo {
+			if lo[i] == 0 && hi[i] == max8 {
+				full++
+			}
+		}
+		if want := map[bool]int{false: 1, true: 3}[anisotropic]; full < want {
+			t.Errorf("anisotropic %v: codes span %v to %v; want %v axes spanning the full range", anisotropic, lo, hi, want)
+		}
+
+		// and inverting the transform recovers the source colors
+		for _, c := range fitted {
+			r, g, b := okLabCodeToRgb(c.labCode, opts.OkLab)
+			for _, d := range [][2]uint16{{c.rgb.x, uint16(r)}, {c.rgb.y, uint16(g)}, {c.rgb.z, uint16(b)}} {
+				if diff := int(d[0]) - int(d[1]); diff < -1 || diff > 1 {
+					t.Fatalf("anisotropic %v: %v round-tripped to %v %v %v", anisotropic, c.rgb, r, g, b)
+				}
+			}
+		}
+
+		// placing colors with a transform other than their own is an error
+		if err := checkOkLab(fitted, opts.OkLab, max8); err != nil {
+			t.Errorf("anisotropic %v: colors do not match their own transform: %v", anisotropic, err)
+		}
+		if checkOkLab(fitted, nil, max8) == nil || checkOkLab(fixed, opts.OkLab, max8) == nil {
+			t.Errorf("anisotropic %v: colors match a transform they were not quantized with", anisotropic)
+		}
+	}
+	if err := checkOkLab(fixed, nil, max8); err != nil {
+		t.Errorf("colors do not match the fixed range: %v", err)
+	}
+
+	// without any colors there is nothing to fit
+	if FitOkLabPalette(nil, false) != nil {
+		t.Errorf("fitting an empty palette gave a transform")
+	}
+}
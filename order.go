@@ -0,0 +1,208 @@
+package pix
+
+// This file implements reading and writing placement orders, so that orders can
+// be computed by external tools and fed back in. An order is a permutation of
+// the sampled colors in which order[i] is the index of the color placed i-th,
+// as returned by SortOrder. There are two formats:
+//
+// The binary format (.order, or any other extension) is the 8 bytes "PIXORDER",
+// the number of colors as a little-endian uint32, and then the order as
+// little-endian uint32 indices. In numpy, np.fromfile(path, "<u4", offset=12).
+//
+// The CSV format (.csv) has a header followed by one record per color in
+// placement order, holding the color's index and, for reference, its source
+// position and 8-bit sRGB color: index,x,y,r,g,b. Only the first column is
+// read back, and a header row, if present, is skipped.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const orderMagic = "PIXORDER"
+
+// Reorders colors in place into the given order, as SortBySimilarity does,
+// after checking that the order is a permutation of the colors.
+func ApplyOrder(colors []SampledColor, order []uint32) error {
+	if err := checkOrder(order, len(colors)); err != nil {
+		return err
+	}
+	applyOrder(colors, append([]uint32(nil), order...))
+	return nil
+}
+
+func checkOrder(order []uint32, n int) error {
+	if len(order) != n {
+		return fmt.Errorf("order has %v entries for %v colors", len(order), n)
+	}
+	seen := make([]bool, n)
+	for i, j := range order {
+		if int64(j) >= int64(n) {
+			return fmt.Errorf("entry %v: index %v is out of range for %v colors", i, j, n)
+		}
+		if seen[j] {
+			return fmt.Errorf("entry %v: index %v appears more than once", i, j)
+		}
+		seen[j] = true
+	}
+	return nil
+}
+
+// Returns the order format for the file extension: "csv" for .csv, and "bin" otherwise.
+func orderFormat(filepath string) string {
+	if strings.ToLower(path.Ext(filepath)) == ".csv" {
+		return "csv"
+	}
+	return "bin"
+}
+
+// Writes the order of the colors to a file, inferring its format from the file extension.
+func SaveOrder(filepath string, colors []SampledColor, order []uint32) error {
+	f, err := os.Create(filepath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	if err := WriteOrder(f, colors, order, orderFormat(filepath)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writes the order of the colors in the given format: "bin" or "csv".
+// The colors are only used by the CSV format, and may be nil otherwise.
+func WriteOrder(w io.Writer, colors []SampledColor, order []uint32, format string) error {
+	if uint64(len(order)) > math.MaxUint32 {
+		return fmt.Errorf("error writing order: too many colors")
+	}
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "bin":
+		bw.WriteString(orderMagic)
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(order)))
+		bw.Write(buf[:])
+		for _, j := range order {
+			binary.LittleEndian.PutUint32(buf[:], j)
+			bw.Write(buf[:])
+		}
+	case "csv":
+		if err := checkOrder(order, len(colors)); err != nil {
+			return fmt.Errorf("error writing order: %w", err)
+		}
+		cw := csv.NewWriter(bw)
+		cw.Write([]string{"index", "x", "y", "r", "g", "b"})
+		for _, j := range order {
+			c := colors[j]
+			cw.Write([]string{
+				strconv.FormatUint(uint64(j), 10),
+				strconv.Itoa(int(c.x)), strconv.Itoa(int(c.y)),
+				strconv.Itoa(int(c.rgb.x)), strconv.Itoa(int(c.rgb.y)), strconv.Itoa(int(c.rgb.z)),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("error writing order: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown order format (we understand bin, csv): %v", format)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing order: %w", err)
+	}
+	return nil
+}
+
+// Loads an order, inferring its format from the file extension.
+func LoadOrder(filepath string) ([]uint32, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+	return LoadOrderFrom(f, orderFormat(filepath))
+}
+
+// Loads an order in the given format: "bin" or "csv". The order is not
+// checked against any colors; ApplyOrder does that.
+func LoadOrderFrom(r io.Reader, format string) ([]uint32, error) {
+	var order []uint32
+	var err error
+	switch format {
+	case "bin":
+		order, err = parseBinaryOrder(bufio.NewReader(r))
+	case "csv":
+		order, err = parseCSVOrder(r)
+	default:
+		return nil, fmt.Errorf("unknown order format (we understand bin, csv): %v", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading order: %w", err)
+	}
+	return order, nil
+}
+
+func parseBinaryOrder(r io.Reader) ([]uint32, error) {
+	var header [len(orderMagic) + 4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("missing header: %w", err)
+	}
+	if !bytes.Equal(header[:len(orderMagic)], []byte(orderMagic)) {
+		return nil, fmt.Errorf("missing %v header", orderMagic)
+	}
+	n := binary.LittleEndian.Uint32(header[len(orderMagic):])
+	// read in chunks rather than trusting the count with one large allocation
+	var order []uint32
+	var buf [4096]byte
+	for rest := uint64(n); rest > 0; {
+		m := uint64(len(buf) / 4)
+		if rest < m {
+			m = rest
+		}
+		if _, err := io.ReadFull(r, buf[:4*m]); err != nil {
+			return nil, fmt.Errorf("expected %v entries, got %v: %w", n, len(order), err)
+		}
+		for i := uint64(0); i < m; i++ {
+			order = append(order, binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+		rest -= m
+	}
+	if _, err := r.Read(buf[:1]); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after %v entries", n)
+	}
+	return order, nil
+}
+
+func parseCSVOrder(r io.Reader) ([]uint32, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var order []uint32
+	for record := 1; ; record++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		j, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 32)
+		if err != nil {
+			if record == 1 {
+				continue // assume that this is the header
+			}
+			return nil, fmt.Errorf("record %v: invalid index %q", record, fields[0])
+		}
+		order = append(order, uint32(j))
+	}
+	return order, nil
+}
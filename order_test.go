@@ -0,0 +1,58 @@
+package pix
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOrderRoundTrip(t *testing.T) {
+	var colors []SampledColor
+	for i := 0; i < 50; i++ {
+		colors = append(colors, sampleColor(ImageColor{i % 7, i / 7, uint16(i) * 0x505, 0x8080, 0}, uint32(i), SampleOptions{}))
+	}
+	opts := SortOptions{Color: 1, Random: 20, Seed: 3}
+	order := SortOrder(colors, opts)
+	want := append([]SampledColor(nil), colors...)
+	SortBySimilarity(want, opts)
+
+	for _, format := range []string{"bin", "csv"} {
+		var buf bytes.Buffer
+		if err := WriteOrder(&buf, colors, order, format); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		got, err := LoadOrderFrom(&buf, format)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		placed := append([]SampledColor(nil), colors...)
+		if err := ApplyOrder(placed, got); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		for i := range placed {
+			if placed[i] != want[i] {
+				t.Fatalf("%v: position %v: got %v; want %v", format, i, placed[i], want[i])
+			}
+		}
+	}
+}
+
+func TestOrderErrors(t *testing.T) {
+	colors := make([]SampledColor, 3)
+	for _, order := range [][]uint32{{0, 1}, {0, 1, 3}, {0, 1, 1}} {
+		if err := ApplyOrder(colors, order); err == nil {
+			t.Errorf("%v: expected an error", order)
+		}
+	}
+	for _, test := range []struct{ format, data string }{
+		{"bin", "PIXORDR\x00"},
+		{"bin", "PIXORDER\x02\x00\x00\x00\x00\x00\x00\x00"},
+		{"bin", "PIXORDER\x00\x00\x00\x00\x01"},
+		{"csv", "index\n0\nx\n"},
+		{"txt", "0\n"},
+	} {
+		if _, err := LoadOrderFrom(strings.NewReader(test.data), test.format); err == nil {
+			t.Errorf("%v %q: expected an error", test.format, test.data)
+		}
+	}
+}
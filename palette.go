@@ -0,0 +1,310 @@
+package pix
+
+// This file implements color sources based on palette files rather than images:
+// GIMP palettes (.gpl), lists of hex codes (.hex), Adobe color tables (.act),
+// and CSV files with either a hex code or r, g, b columns, followed by an
+// optional weight column (.csv).
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A PaletteColor is an 8-bit sRGB color along with its relative weight in the palette.
+type PaletteColor struct {
+	R, G, B uint8
+	Weight  float64
+}
+
+// Loads a palette, inferring its format from the file extension.
+func LoadPalette(filepath string) ([]PaletteColor, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+	format := strings.TrimPrefix(strings.ToLower(path.Ext(filepath)), ".")
+	return LoadPaletteFrom(f, format)
+}
+
+// Loads a palette in the given format: "gpl", "hex", "act", or "csv".
+func LoadPaletteFrom(r io.Reader, format string) ([]PaletteColor, error) {
+	var palette []PaletteColor
+	var err error
+	switch format {
+	case "gpl":
+		palette, err = parseGPL(r)
+	case "hex":
+		palette, err = parseHex(r)
+	case "act":
+		palette, err = parseACT(r)
+	case "csv":
+		palette, err = parseCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown palette format (we understand gpl, hex, act, csv): %v", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading palette: %w", err)
+	}
+	if len(palette) == 0 {
+		return nil, fmt.Errorf("error loading palette: no colors found")
+	}
+	return palette, nil
+}
+
+func parseGPL(r io.Reader) ([]PaletteColor, error) {
+	var palette []PaletteColor
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if line == 1 {
+			if text != "GIMP Palette" {
+				return nil, fmt.Errorf("missing GIMP Palette header")
+			}
+			continue
+		}
+		if text == "" || text[0] == '#' || strings.HasPrefix(text, "Name:") || strings.HasPrefix(text, "Columns:") {
+			continue
+		}
+		// each color is on its own line as "r g b", optionally followed by a name
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %v: expected r g b values", line)
+		}
+		r, g, b, err := parseRGB(fields[:3])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		palette = append(palette, PaletteColor{r, g, b, 1})
+	}
+	return palette, scanner.Err()
+}
+
+func parseHex(r io.Reader) ([]PaletteColor, error) {
+	var palette []PaletteColor
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		// each color is on its own line as a hex code, optionally followed by a weight
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0][0] == ';' {
+			continue
+		}
+		r, g, b, err := parseHexColor(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		weight := 1.0
+		if len(fields) > 1 {
+			if weight, err = parseWeight(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+		}
+		palette = append(palette, PaletteColor{r, g, b, weight})
+	}
+	return palette, scanner.Err()
+}
+
+// An Adobe color table holds 256 rgb triples, optionally followed
+// by a 16-bit color count and the 16-bit index of a transparent color.
+func parseACT(r io.Reader) ([]PaletteColor, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 768 && len(data) != 772 {
+		return nil, fmt.Errorf("expected 768 or 772 bytes, got %v", len(data))
+	}
+	n, transparent := 256, -1
+	if len(data) == 772 {
+		n = int(data[768])<<8 | int(data[769])
+		if n == 0 || n > 256 {
+			n = 256
+		}
+		if t := int(data[770])<<8 | int(data[771]); t < n {
+			transparent = t
+		}
+	}
+	var palette []PaletteColor
+	for i := 0; i < n; i++ {
+		if i != transparent {
+			palette = append(palette, PaletteColor{data[3*i], data[3*i+1], data[3*i+2], 1})
+		}
+	}
+	return palette, nil
+}
+
+// Each record holds either a hex code or r, g, b values, optionally
+// followed by a weight. A header row, if present, is skipped: a first
+// record that is not a color is taken for a header if its first field
+// has no digits, like "r" or "color", and is an error otherwise.
+func parseCSV(r io.Reader) ([]PaletteColor, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var palette []PaletteColor
+	for record := 1; ; record++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseCSVRecord(fields)
+		if err != nil {
+			if record == 1 && !strings.ContainsAny(fields[0], "0123456789") {
+				continue // assume that this is the header
+			}
+			return nil, fmt.Errorf("record %v: %w", record, err)
+		}
+		palette = append(palette, c)
+	}
+	return palette, nil
+}
+
+func parseCSVRecord(fields []string) (PaletteColor, error) {
+	var c PaletteColor
+	var err error
+	var rest []string
+	if len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") {
+		if c.R, c.G, c.B, err = parseRGB(fields[:3]); err != nil {
+			return c, err
+		}
+		rest = fields[3:]
+	} else {
+		if c.R, c.G, c.B, err = parseHexColor(fields[0]); err != nil {
+			return c, err
+		}
+		rest = fields[1:]
+	}
+	c.Weight = 1
+	if len(rest) > 0 && rest[0] != "" {
+		if c.Weight, err = parseWeight(rest[0]); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func parseRGB(fields []string) (uint8, uint8, uint8, error) {
+	var rgb [3]uint8
+	for i, field := range fields {
+		v, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid color component %q", field)
+		}
+		rgb[i] = uint8(v)
+	}
+	return rgb[0], rgb[1], rgb[2], nil
+}
+
+// parse a hex color in the form #rrggbb or #rgb, with an optional #
+func parseHexColor(s string) (uint8, uint8, uint8, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return 0, 0, 0, fmt.Errorf("invalid hex color %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid hex color %q", s)
+	}
+	return uint8(v >> 16), uint8(v >> 8), uint8(v), nil
+}
+
+func parseWeight(s string) (float64, error) {
+	w, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || w < 0 {
+		return 0, fmt.Errorf("invalid weight %q", s)
+	}
+	return w, nil
+}
+
+// Returns nPixels colors from the palette, with each color repeated
+// a number of times proportional to its weight. Since there is no source
+// image, the xy codes used for image-space sorting follow palette order,
+// as do source positions, which place the colors in a single row.
+func SamplePalette(palette []PaletteColor, nPixels int, opts SampleOptions) ([]SampledColor, error) {
+	weights := make([]float64, len(palette))
+	for i, c := range palette {
+		weights[i] = c.Weight
+	}
+	counts, err := apportion(weights, nPixels)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]SampledColor, 0, nPixels)
+	for i, c := range palette {
+		x := sampleColor(ImageColor{0, 0, uint16(c.R) * 0x101, uint16(c.G) * 0x101, uint16(c.B) * 0x101}, 0, opts)
+		for j := 0; j < counts[i]; j++ {
+			x.xyCode, x.x = uint32(len(ret)), int32(len(ret))
+			ret = append(ret, x)
+		}
+	}
+	return ret, nil
+}
+
+// Returns nPixels colors along a gradient through the palette colors
+// in order, interpolated in OkLab. Each palette color appears once, as
+// an endpoint of the gradient's segments, and the segment between each pair
+// of adjacent colors receives a share of the remaining samples proportional
+// to their average weight. If there are fewer samples than palette colors,
+// the palette is sampled as by SamplePalette. As with SamplePalette, xy codes
+// follow the order of the gradient.
+func SampleGradient(palette []PaletteColor, nPixels int, opts SampleOptions) ([]SampledColor, error) {
+	if len(palette) < 2 || nPixels < len(palette) {
+		return SamplePalette(palette, nPixels, opts)
+	}
+	type lab struct{ L, a, b float64 }
+	labs := make([]lab, len(palette))
+	for i, c := range palette {
+		L, a, b := linear_srgb_to_oklab(
+			toLinearRGB(uint16(c.R), max8),
+			toLinearRGB(uint16(c.G), max8),
+			toLinearRGB(uint16(c.B), max8))
+		labs[i] = lab{L, a, b}
+	}
+	weights := make([]float64, len(palette)-1)
+	for i := range weights {
+		weights[i] = (palette[i].Weight + palette[i+1].Weight) / 2
+	}
+	counts, err := apportion(weights, nPixels-len(palette))
+	if err != nil {
+		return nil, err
+	}
+	max := codeMax(opts.HighPrecision)
+	ret := make([]SampledColor, 0, nPixels)
+	for i, c := range palette {
+		// the palette color itself, sampled exactly as by SamplePalette
+		x := sampleColor(ImageColor{0, 0, uint16(c.R) * 0x101, uint16(c.G) * 0x101, uint16(c.B) * 0x101}, 0, opts)
+		x.xyCode, x.x = uint32(len(ret)), int32(len(ret))
+		ret = append(ret, x)
+		if i == len(counts) {
+			break
+		}
+		p, q, n := labs[i], labs[i+1], counts[i]
+		for j := 1; j <= n; j++ {
+			// sample at the interior points of n+1 equal subdivisions of the segment
+			t := float64(j) / float64(n+1)
+			L, a, b := p.L+t*(q.L-p.L), p.a+t*(q.a-p.a), p.b+t*(q.b-p.b)
+			r, g, bl := oklab_to_linear_srgb(L, a, b)
+			rgb := Color{
+				uint16(toNonlinearRGBLUT(clamp(r, 0, 1))),
+				uint16(toNonlinearRGBLUT(clamp(g, 0, 1))),
+				uint16(toNonlinearRGBLUT(clamp(bl, 0, 1)))}
+			lab := opts.OkLab.quantize(L, a, b, max)
+			rgbCode := mortonCode(rgb.x, rgb.y, rgb.z)
+			labCode := mortonCode(lab.x, lab.y, lab.z)
+			ret = append(ret, SampledColor{rgb, lab, rgbCode, labCode, uint32(len(ret)), int32(len(ret)), 0})
+		}
+	}
+	return ret, nil
+}
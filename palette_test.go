@@ -0,0 +1,123 @@
+package pix
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoadPaletteFrom(t *testing.T) {
+	act := make([]byte, 772)
+	copy(act, []byte{255, 0, 0, 0, 255, 0, 0, 0, 255})
+	act[769], act[771] = 3, 1 // three colors, the second of which is transparent
+
+	tests := []struct {
+		format, data string
+		want         []PaletteColor
+	}{
+		{"gpl", "GIMP Palette\nName: test\nColumns: 2\n# comment\n255   0   0 red\n  0 128 255\n",
+			[]PaletteColor{{255, 0, 0, 1}, {0, 128, 255, 1}}},
+		{"hex", "ff0000\n\n#0080ff 2.5\n; comment\n#abc\n",
+			[]PaletteColor{{255, 0, 0, 1}, {0, 128, 255, 2.5}, {0xaa, 0xbb, 0xcc, 1}}},
+		{"act", string(act),
+			[]PaletteColor{{255, 0, 0, 1}, {0, 0, 255, 1}}},
+		{"csv", "r,g,b,weight\n255,0,0,3\n0, 128, 255\n",
+			[]PaletteColor{{255, 0, 0, 3}, {0, 128, 255, 1}}},
+		{"csv", "#ff0000,2\n0080ff\n",
+			[]PaletteColor{{255, 0, 0, 2}, {0, 128, 255, 1}}},
+	}
+	for _, test := range tests {
+		got, err := LoadPaletteFrom(bytes.NewReader([]byte(test.data)), test.format)
+		if err != nil {
+			t.Errorf("%v %q: unexpected error: %v", test.format, test.data, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v %q: got %v; want %v", test.format, test.data, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v %q: got %v; want %v", test.format, test.data, got, test.want)
+				break
+			}
+		}
+	}
+
+	errors := []struct{ format, data string }{
+		{"gpl", "255 0 0\n"},          // missing header
+		{"hex", "ff00zz\n"},           // invalid hex
+		{"hex", "ff0000 -1\n"},        // negative weight
+		{"csv", "255,0,0\n256,0,0\n"}, // out of range component
+		{"csv", "256,0,0\n255,0,0\n"}, // malformed first record
+		{"csv", "#ff00zz\n#ff0000\n"}, // malformed first hex color
+		{"act", "\x00\x00\x00"},       // wrong size
+		{"xyz", "ff0000\n"},           // unknown format
+		{"hex", "; only a comment\n"}, // no colors
+	}
+	for _, test := range errors {
+		if _, err := LoadPaletteFrom(strings.NewReader(test.data), test.format); err == nil {
+			t.Errorf("%v %q: expected an error", test.format, test.data)
+		}
+	}
+}
+
+func TestSamplePalette(t *testing.T) {
+	palette := []PaletteColor{{255, 0, 0, 3}, {0, 0, 255, 1}}
+	colors, err := SamplePalette(palette, 8, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(colors) != 8 {
+		t.Fatalf("got %v colors; want 8", len(colors))
+	}
+	for i, c := range colors {
+		wantRed := i < 6
+		if (c.rgb == Color{255, 0, 0}) != wantRed {
+			t.Errorf("color %v: got %v", i, c.rgb)
+		}
+		if c.xyCode != uint32(i) {
+			t.Errorf("color %v: got xy code %v; want %v", i, c.xyCode, i)
+		}
+	}
+
+	// gradients run from the first color to the last in order
+	colors, err = SampleGradient([]PaletteColor{{0, 0, 0, 1}, {255, 255, 255, 1}}, 10, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(colors) != 10 {
+		t.Fatalf("got %v gradient colors; want 10", len(colors))
+	}
+	for i := 1; i < len(colors); i++ {
+		if colors[i].lab.x <= colors[i-1].lab.x {
+			t.Errorf("gradient lightness is not increasing at %v: %v", i, colors)
+		}
+	}
+
+	// every palette color appears exactly once, even with few samples
+	palette = []PaletteColor{{255, 0, 0, 1}, {0, 255, 0, 1}, {0, 0, 255, 1}}
+	for _, n := range []int{3, 4, 7} {
+		colors, err = SampleGradient(palette, n, SampleOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(colors) != n {
+			t.Fatalf("got %v gradient colors; want %v", len(colors), n)
+		}
+		for _, c := range palette {
+			rgb, count := Color{uint16(c.R), uint16(c.G), uint16(c.B)}, 0
+			for _, x := range colors {
+				if x.rgb == rgb {
+					count++
+				}
+			}
+			if count != 1 {
+				t.Errorf("%v samples: palette color %v appears %v times; want once", n, rgb, count)
+			}
+		}
+		if first, last := colors[0].rgb, colors[n-1].rgb; first != (Color{255, 0, 0}) || last != (Color{0, 0, 255}) {
+			t.Errorf("%v samples: gradient runs from %v to %v", n, first, last)
+		}
+	}
+}
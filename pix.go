@@ -1,7 +1,9 @@
 package pix
 
 import (
+	"fmt"
 	"image/png"
+	"time"
 )
 
 type Options struct {
@@ -11,12 +13,58 @@ type Options struct {
 	Seeds            []int
 	Output           string
 	CompressionLevel png.CompressionLevel
+	HighPrecision    bool // use 10-bit color codes and write 16-bit output; see SampleOptions
+	// Color space in which colors are matched; output is converted back to sRGB
+	ColorSpace ColorSpace
+	// Transform the colors' OkLab codes were quantized with, or nil; see SampleOptions.OkLab
+	OkLab *OkLabTransform
+	// Relative weights of the color space's axes in color distances; zero weights them equally
+	AxisWeights [3]float64
+	// Write exact 8-bit source colors rather than decoding them from color codes
+	ExactColors bool
+	// Place each color exactly once, writing exact colors, and check that none was dropped
+	Unique bool
+	// Re-rank the RerankK nearest candidates by their exact colors; see Rerank
+	Rerank  Rerank
+	RerankK int // 0 means DefaultRerankK
+	// If non-nil, receives statistics about the placement
+	Stats *PlaceStats
+}
+
+// Statistics about a placement, used to measure the quality and overhead of
+// re-ranking. Color differences are measured with the re-ranking formula.
+type PlaceStats struct {
+	Placed     int           // colors placed by nearest-neighbor search, excluding seeds
+	Changed    int           // placements for which re-ranking chose other than the nearest code
+	BaseDeltaE float64       // total difference between each color and its nearest candidate by code
+	DeltaE     float64       // total difference between each color and the chosen candidate
+	SearchTime time.Duration // time spent in nearest-neighbor searches
+	RerankTime time.Duration // time spent re-ranking candidates
+	PlaceTime  time.Duration // time spent placing the colors counted by Placed, including searches and re-ranking
 }
 
 func Place(colors []SampledColor, opts Options) error {
 
+	if opts.Unique && len(colors) != opts.Width*opts.Height {
+		return fmt.Errorf("unique placement requires exactly one color per pixel; got %v colors for %v pixels", len(colors), opts.Width*opts.Height)
+	}
+
+	for _, w := range opts.AxisWeights {
+		if !(w >= 0) {
+			return fmt.Errorf("axis weights must be nonnegative; got %v", opts.AxisWeights)
+		}
+	}
+
+	if opts.RerankK < 0 {
+		return fmt.Errorf("the number of candidates to re-rank must be positive; got %v", opts.RerankK)
+	}
+
+	if err := checkOkLab(colors, opts.OkLab, codeMax(opts.HighPrecision)); err != nil {
+		return err
+	}
+
 	// Create a canvas object
-	canvas := NewCanvas(opts.Width, opts.Height, opts.RandomSeed)
+	canvas := NewCanvas(opts)
 
 	// Place an initial seed color in the middle of the canvas
 	seeds := opts.Seeds
@@ -29,9 +77,19 @@ func Place(colors []SampledColor, opts Options) error {
 	}
 
 	// Place the rest of the colors using the growth algorithm
+	start := time.Now()
 	for _, color := range rest {
 		canvas.Place(color)
 	}
+	if opts.Stats != nil {
+		opts.Stats.PlaceTime += time.Since(start)
+	}
+
+	if opts.Unique {
+		if err := canvas.CheckUnique(colors); err != nil {
+			return fmt.Errorf("unique placement failed: %w", err)
+		}
+	}
 
 	// Save the output image
 	outPath := opts.Output
@@ -0,0 +1,224 @@
+package pix
+
+// This file implements a decoder for the Netpbm PGM and PPM formats,
+// in both their plain (ASCII) and raw (binary) variants:
+// http://netpbm.sourceforge.net/doc/pgm.html
+// http://netpbm.sourceforge.net/doc/ppm.html
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+func init() {
+	for _, magic := range []string{"P2", "P3", "P5", "P6"} {
+		image.RegisterFormat("pnm", magic, decodePNM, decodePNMConfig)
+	}
+}
+
+// The largest number of pixels we decode, which bounds the memory that
+// a small, possibly untrusted, header can make us allocate
+const pnmMaxPixels = 1 << 28
+
+type pnmHeader struct {
+	magic         byte // '2', '3', '5', or '6'
+	width, height int
+	maxVal        int
+}
+
+func (h pnmHeader) channels() int {
+	if h.magic == '3' || h.magic == '6' {
+		return 3
+	}
+	return 1
+}
+
+func (h pnmHeader) colorModel() color.Model {
+	switch {
+	case h.channels() == 1 && h.maxVal < 256:
+		return color.GrayModel
+	case h.channels() == 1:
+		return color.Gray16Model
+	case h.maxVal < 256:
+		return color.RGBAModel
+	default:
+		return color.RGBA64Model
+	}
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: h.colorModel(), Width: h.width, Height: h.height}, nil
+}
+
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPNMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// read all samples in row major order, rescaled to 16 bits.
+	// the buffer grows as samples are read so that truncated data fails
+	// before we allocate memory for the full image.
+	n := h.width * h.height * h.channels()
+	capacity := n
+	if capacity > 1<<20 {
+		capacity = 1 << 20
+	}
+	samples := make([]uint16, 0, capacity)
+	raw := h.magic == '5' || h.magic == '6'
+	wide := h.maxVal > 255
+	for len(samples) < n {
+		var v int
+		if raw {
+			hi, err := br.ReadByte()
+			if err != nil {
+				return nil, pnmDataErr(err)
+			}
+			v = int(hi)
+			if wide {
+				lo, err := br.ReadByte()
+				if err != nil {
+					return nil, pnmDataErr(err)
+				}
+				v = v<<8 | int(lo)
+			}
+		} else {
+			v, err = readPNMInt(br)
+			if err != nil {
+				return nil, pnmDataErr(err)
+			}
+		}
+		if v > h.maxVal {
+			return nil, fmt.Errorf("pnm: sample value %v exceeds maximum %v", v, h.maxVal)
+		}
+		samples = append(samples, uint16((v*0xffff+h.maxVal/2)/h.maxVal))
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	switch h.colorModel() {
+	case color.GrayModel:
+		img := image.NewGray(rect)
+		for i, s := range samples {
+			img.Pix[i] = uint8(s >> 8)
+		}
+		return img, nil
+	case color.Gray16Model:
+		img := image.NewGray16(rect)
+		for i, s := range samples {
+			img.Pix[2*i], img.Pix[2*i+1] = uint8(s>>8), uint8(s)
+		}
+		return img, nil
+	case color.RGBAModel:
+		img := image.NewRGBA(rect)
+		for i := 0; i < len(samples); i += 3 {
+			j := i / 3 * 4
+			img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = uint8(samples[i]>>8), uint8(samples[i+1]>>8), uint8(samples[i+2]>>8), 255
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA64(rect)
+		for i := 0; i < len(samples); i++ {
+			j := i/3*8 + i%3*2
+			img.Pix[j], img.Pix[j+1] = uint8(samples[i]>>8), uint8(samples[i])
+			if i%3 == 2 {
+				img.Pix[j+2], img.Pix[j+3] = 255, 255
+			}
+		}
+		return img, nil
+	}
+}
+
+func readPNMHeader(br *bufio.Reader) (pnmHeader, error) {
+	var h pnmHeader
+	var magic [2]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return h, fmt.Errorf("pnm: error reading header: %w", err)
+	}
+	if magic[0] != 'P' || (magic[1] != '2' && magic[1] != '3' && magic[1] != '5' && magic[1] != '6') {
+		return h, errors.New("pnm: unsupported format (we understand P2, P3, P5, P6)")
+	}
+	h.magic = magic[1]
+	var err error
+	if h.width, err = readPNMInt(br); err != nil {
+		return h, fmt.Errorf("pnm: error reading width: %w", err)
+	}
+	if h.height, err = readPNMInt(br); err != nil {
+		return h, fmt.Errorf("pnm: error reading height: %w", err)
+	}
+	if h.maxVal, err = readPNMInt(br); err != nil {
+		return h, fmt.Errorf("pnm: error reading maximum value: %w", err)
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return h, fmt.Errorf("pnm: invalid dimensions %vx%v", h.width, h.height)
+	}
+	if h.width > pnmMaxPixels/h.height {
+		return h, fmt.Errorf("pnm: image of %vx%v pixels is too large", h.width, h.height)
+	}
+	if h.maxVal <= 0 || h.maxVal > 0xffff {
+		return h, fmt.Errorf("pnm: invalid maximum value %v", h.maxVal)
+	}
+	// exactly one whitespace character separates the header from raw data
+	if h.magic == '5' || h.magic == '6' {
+		if _, err := br.ReadByte(); err != nil {
+			return h, fmt.Errorf("pnm: error reading header: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// read a non-negative decimal integer, skipping leading whitespace and comments.
+// the whitespace character terminating the integer is left unread.
+func readPNMInt(br *bufio.Reader) (int, error) {
+	var b byte
+	var err error
+	for {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+		if b == '#' {
+			if _, err = br.ReadString('\n'); err != nil {
+				return 0, err
+			}
+		} else if !isPNMSpace(b) {
+			break
+		}
+	}
+	if b < '0' || b > '9' {
+		return 0, fmt.Errorf("unexpected character %q", b)
+	}
+	n := 0
+	for {
+		n = 10*n + int(b-'0')
+		if n > 1<<24 {
+			return 0, errors.New("integer out of range")
+		}
+		if b, err = br.ReadByte(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if b < '0' || b > '9' {
+			return n, br.UnreadByte()
+		}
+	}
+}
+
+func isPNMSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func pnmDataErr(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("pnm: error reading image data: %w", err)
+}
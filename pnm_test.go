@@ -0,0 +1,54 @@
+package pix
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePNM(t *testing.T) {
+	tests := []struct {
+		data string
+		want []color.RGBA
+	}{
+		{"P3\n2 1\n255\n255 0 0  0 0 255\n", []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}},
+		{"P3 # comment\n2 1 15\n15 0 0 0 0 15", []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}},
+		{"P6\n2 1\n255\n\xff\x00\x00\x00\x00\xff", []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}},
+		{"P6 1 1 65535\n\xff\xff\x80\x00\x00\x00", []color.RGBA{{255, 128, 0, 255}}},
+		{"P2\n2 1\n255\n0 255\n", []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}}},
+		{"P5\n2 1\n255\n\x00\x80", []color.RGBA{{0, 0, 0, 255}, {128, 128, 128, 255}}},
+	}
+	for _, test := range tests {
+		img, format, err := image.Decode(bytes.NewReader([]byte(test.data)))
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.data, err)
+			continue
+		}
+		if format != "pnm" {
+			t.Errorf("%q: got format %v; want pnm", test.data, format)
+		}
+		for x, want := range test.want {
+			got := color.RGBAModel.Convert(img.At(x, 0)).(color.RGBA)
+			if got != want {
+				t.Errorf("%q: pixel %v: got %v; want %v", test.data, x, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodePNMErrors(t *testing.T) {
+	tests := []string{
+		"P6\n2 1\n255\n\xff\x00\x00", // truncated data
+		"P3\n1 1\n15\n16 0 0",        // sample exceeds maxval
+		"P3\n0 1\n255\n",             // zero width
+		"P5\n1 1\n70000\n\x00",       // maxval out of range
+		"P6 16777216 16777216 255\n", // too many pixels
+		"P6 16384 16384 255\n\x00",   // truncated data for a large image
+	}
+	for _, data := range tests {
+		if _, _, err := image.Decode(bytes.NewReader([]byte(data))); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
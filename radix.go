@@ -0,0 +1,186 @@
+package pix
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Below this many colors, sorting by score uses the sort package
+const radixSortThreshold = 1 << 16
+
+// A permutation of colors along with the sort score of the color at each position
+type scoredOrder struct {
+	scores []float64
+	perm   []uint32
+}
+
+func (o scoredOrder) Len() int           { return len(o.perm) }
+func (o scoredOrder) Less(i, j int) bool { return o.scores[i] < o.scores[j] }
+func (o scoredOrder) Swap(i, j int) {
+	o.scores[i], o.scores[j] = o.scores[j], o.scores[i]
+	o.perm[i], o.perm[j] = o.perm[j], o.perm[i]
+}
+
+// Sorts perm by ascending score, where scores[i] is the score of perm[i], and
+// reorders scores to match. Large permutations are sorted with a parallel
+// radix sort, which is stable; since sort.Sort is not, the two may order ties
+// differently.
+func sortByScore(scores []float64, perm []uint32) {
+	if len(perm) < radixSortThreshold {
+		sort.Sort(scoredOrder{scores, perm})
+		return
+	}
+	radixSortByScore(scores, perm, runtime.GOMAXPROCS(0))
+}
+
+// Like sortByScore, but keeps colors with equal scores in their existing order.
+func stableSortByScore(scores []float64, perm []uint32) {
+	if len(perm) < radixSortThreshold {
+		sort.Stable(scoredOrder{scores, perm})
+		return
+	}
+	radixSortByScore(scores, perm, runtime.GOMAXPROCS(0))
+}
+
+// Returns an integer key with the same order as the float (with -0 before +0).
+// Flipping the sign bit of positive floats puts them above the negatives, and
+// flipping all the bits of negative floats reverses their order.
+func floatKey(f float64) uint64 {
+	b := math.Float64bits(f)
+	if b>>63 == 1 {
+		return ^b
+	}
+	return b | 1<<63
+}
+
+// The inverse of floatKey
+func keyFloat(k uint64) float64 {
+	if k>>63 == 1 {
+		return math.Float64frombits(k &^ (1 << 63))
+	}
+	return math.Float64frombits(^k)
+}
+
+// Stably sorts perm by ascending score with an LSD radix sort over the
+// scores' integer keys, and reorders scores to match. Each pass splits
+// the keys among nWorkers goroutines.
+func radixSortByScore(scores []float64, perm []uint32, nWorkers int) {
+	n := len(perm)
+	if uint64(n) > math.MaxUint32 {
+		panic("radixSortByScore: too many colors")
+	}
+	if n < 2 {
+		return
+	}
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	// give every worker a nonempty chunk
+	chunk := (n + nWorkers - 1) / nWorkers
+	nWorkers = (n + chunk - 1) / chunk
+	keys := make([]uint64, n)
+	for i, s := range scores {
+		keys[i] = floatKey(s)
+	}
+	keys2, perm2 := make([]uint64, n), make([]uint32, n)
+	dst := perm
+
+	const digitBits = 11
+	const nBuckets = 1 << digitBits
+	counts := make([][nBuckets]int, nWorkers)
+	parallel := func(f func(w, lo, hi int)) {
+		var wg sync.WaitGroup
+		for w := 0; w < nWorkers; w++ {
+			lo, hi := w*chunk, (w+1)*chunk
+			if hi > n {
+				hi = n
+			}
+			wg.Add(1)
+			go func(w, lo, hi int) {
+				defer wg.Done()
+				f(w, lo, hi)
+			}(w, lo, hi)
+		}
+		wg.Wait()
+	}
+
+	for shift := uint(0); shift < 64; shift += digitBits {
+		// count the digits in each worker's chunk
+		parallel(func(w, lo, hi int) {
+			c := &counts[w]
+			*c = [nBuckets]int{}
+			for _, k := range keys[lo:hi] {
+				c[k>>shift&(nBuckets-1)]++
+			}
+		})
+		// skip the pass if every key has the same digit, as high digits often do
+		skip := false
+		for b := 0; b < nBuckets; b++ {
+			total := 0
+			for w := range counts {
+				total += counts[w][b]
+			}
+			if total == n {
+				skip = true
+				break
+			} else if total > 0 {
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		// turn the counts into starting offsets: bucket-major, then worker-major,
+		// so that each worker's keys land after those of earlier workers
+		offset := 0
+		for b := 0; b < nBuckets; b++ {
+			for w := range counts {
+				count := counts[w][b]
+				counts[w][b] = offset
+				offset += count
+			}
+		}
+		parallel(func(w, lo, hi int) {
+			c := &counts[w]
+			for i := lo; i < hi; i++ {
+				k := keys[i]
+				b := k >> shift & (nBuckets - 1)
+				j := c[b]
+				keys2[j], perm2[j] = k, perm[i]
+				c[b]++
+			}
+		})
+		keys, keys2 = keys2, keys
+		perm, perm2 = perm2, perm
+	}
+
+	copy(dst, perm)
+	for i, k := range keys {
+		scores[i] = keyFloat(k)
+	}
+}
+
+// Reorders colors in place so that position i receives the color previously
+// at perm[i]. Follows each cycle of the permutation, marking positions as done
+// by pointing them at themselves, so perm is left as the identity.
+func applyOrder(colors []SampledColor, perm []uint32) {
+	for i := range perm {
+		if perm[i] == uint32(i) {
+			continue
+		}
+		tmp := colors[i]
+		j := i
+		for {
+			k := int(perm[j])
+			perm[j] = uint32(j)
+			if k == i {
+				colors[j] = tmp
+				break
+			}
+			colors[j] = colors[k]
+			j = k
+		}
+	}
+}
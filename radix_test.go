@@ -0,0 +1,94 @@
+package pix
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRadixSortByScore(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 1000, 100000} {
+		scores, perm := make([]float64, n), make([]uint32, n)
+		for i := range scores {
+			perm[i] = uint32(i) // distinguishes ties
+			switch rng.Intn(4) {
+			case 0:
+				scores[i] = float64(rng.Intn(10)) // plenty of ties
+			case 1:
+				scores[i] = -rng.Float64() * 1e6
+			case 2:
+				scores[i] = rng.NormFloat64() * 1e-300
+			default:
+				scores[i] = math.Inf(1 - 2*rng.Intn(2))
+			}
+		}
+		wantScores, wantPerm := append([]float64(nil), scores...), append([]uint32(nil), perm...)
+		sort.Stable(scoredOrder{wantScores, wantPerm})
+		for _, nWorkers := range []int{1, 3, 8} {
+			gotScores, gotPerm := append([]float64(nil), scores...), append([]uint32(nil), perm...)
+			radixSortByScore(gotScores, gotPerm, nWorkers)
+			for i := range wantPerm {
+				if gotPerm[i] != wantPerm[i] || math.Float64bits(gotScores[i]) != math.Float64bits(wantScores[i]) {
+					t.Fatalf("n = %v, %v workers: position %v: got %v (%v); want %v (%v)",
+						n, nWorkers, i, gotPerm[i], gotScores[i], wantPerm[i], wantScores[i])
+				}
+			}
+		}
+	}
+
+	// scores in a narrow range skip most passes
+	scores, perm := make([]float64, 1000), make([]uint32, 1000)
+	for i := range scores {
+		scores[i], perm[i] = 0.5+float64(len(scores)-i)*1e-12, uint32(i)
+	}
+	radixSortByScore(scores, perm, 4)
+	for i := 1; i < len(scores); i++ {
+		if scores[i] < scores[i-1] || perm[i] > perm[i-1] {
+			t.Fatalf("narrow scores are out of order at %v", i)
+		}
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	colors := make([]SampledColor, 6)
+	for i := range colors {
+		colors[i].xyCode = uint32(i)
+	}
+	perm := []uint32{2, 0, 1, 3, 5, 4}
+	want := append([]uint32(nil), perm...)
+	applyOrder(colors, perm)
+	for i, c := range colors {
+		if c.xyCode != want[i] {
+			t.Fatalf("position %v: got color %v; want %v", i, c.xyCode, want[i])
+		}
+	}
+}
+
+func BenchmarkSortByScore(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	scores := make([]float64, 1<<22)
+	for i := range scores {
+		scores[i] = rng.Float64()
+	}
+	scratch, perm := make([]float64, len(scores)), make([]uint32, len(scores))
+	reset := func() {
+		copy(scratch, scores)
+		for i := range perm {
+			perm[i] = uint32(i)
+		}
+	}
+	b.Run("radix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset()
+			sortByScore(scratch, perm)
+		}
+	})
+	b.Run("sort.Sort", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset()
+			sort.Sort(scoredOrder{scratch, perm})
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package pix
+
+import (
+	"math"
+	"time"
+)
+
+// A Rerank is a color difference formula used to re-rank the nearest
+// candidates of each placement. The nearest-neighbor search minimizes
+// the squared distance between quantized codes, which is fast but only
+// approximately perceptual. Re-ranking collects the k nearest frontier
+// colors by that distance and places the color next to the candidate
+// whose exact 8-bit sRGB color differs least from its own by the formula,
+// computed in float64 on unquantized values.
+//
+// Sampled colors keep only their 8-bit sRGB values, so in high-precision mode,
+// where codes have 10 bits per channel, the formula compares colors more
+// coarsely than the search does, and re-ranking mostly breaks ties among
+// candidates whose 8-bit colors differ.
+type Rerank int
+
+const (
+	// Place each color next to its nearest code, without re-ranking
+	RerankNone Rerank = iota
+	// Euclidean distance in unquantized OkLab
+	RerankOkLab
+	// CIEDE2000, the CIE's current color difference formula, in CIELAB
+	RerankCIEDE2000
+)
+
+// The number of candidates re-ranked when Options.RerankK is zero
+const DefaultRerankK = 8
+
+// Linear values of the 8-bit sRGB channel values
+var linearRGB8 = func() (lut [max8 + 1]float64) {
+	for i := range lut {
+		lut[i] = toLinearRGB(uint16(i), max8)
+	}
+	return lut
+}()
+
+// convert an 8-bit sRGB color to the space in which the formula measures differences
+func (r Rerank) lab(rgb Color) [3]float64 {
+	lr, lg, lb := linearRGB8[rgb.x], linearRGB8[rgb.y], linearRGB8[rgb.z]
+	var L, A, B float64
+	if r == RerankCIEDE2000 {
+		L, A, B = linearRgbToCIELAB(lr, lg, lb)
+	} else {
+		L, A, B = linear_srgb_to_oklab(lr, lg, lb)
+	}
+	return [3]float64{L, A, B}
+}
+
+// the difference between two colors returned by lab
+func (r Rerank) deltaE(p, q [3]float64) float64 {
+	if r == RerankCIEDE2000 {
+		return ciede2000(p, q)
+	}
+	dL, dA, dB := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+	return math.Sqrt(dL*dL + dA*dA + dB*dB)
+}
+
+// The CIEDE2000 color difference between two CIELAB colors, with unit weighting
+// factors, following Sharma, Wu and Dalal, "The CIEDE2000 Color-Difference Formula:
+// Implementation Notes, Supplementary Test Data, and Mathematical Observations":
+// http://www2.ece.rochester.edu/~gsharma/ciede2000/
+func ciede2000(p, q [3]float64) float64 {
+	const deg = math.Pi / 180
+	const pow25to7 = 6103515625 // 25^7
+	L1, a1, b1 := p[0], p[1], p[2]
+	L2, a2, b2 := q[0], q[1], q[2]
+
+	// adjust a to even out the chroma of neutral colors
+	cBar := (math.Hypot(a1, b1) + math.Hypot(a2, b2)) / 2
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25to7)))
+	a1, a2 = (1+g)*a1, (1+g)*a2
+	c1, c2 := math.Hypot(a1, b1), math.Hypot(a2, b2)
+	h1, h2 := hueDegrees(a1, b1), hueDegrees(a2, b2)
+
+	// differences in lightness, chroma and hue
+	dL, dC := L2-L1, c2-c1
+	var dh float64
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(dh/2*deg)
+
+	// means, with the mean hue taken the short way around the circle
+	lBar, cBar := (L1+L2)/2, (c1+c2)/2
+	hBar := h1 + h2
+	if c1*c2 != 0 {
+		if math.Abs(h1-h2) <= 180 {
+			hBar /= 2
+		} else if hBar < 360 {
+			hBar = (hBar + 360) / 2
+		} else {
+			hBar = (hBar - 360) / 2
+		}
+	}
+
+	// weighting functions and the rotation term for blue
+	t := 1 - 0.17*math.Cos((hBar-30)*deg) + 0.24*math.Cos(2*hBar*deg) +
+		0.32*math.Cos((3*hBar+6)*deg) - 0.20*math.Cos((4*hBar-63)*deg)
+	l50 := (lBar - 50) * (lBar - 50)
+	sL := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sC := 1 + 0.045*cBar
+	sH := 1 + 0.015*cBar*t
+	cBar7 = math.Pow(cBar, 7)
+	dTheta := 30 * math.Exp(-((hBar-275)/25)*((hBar-275)/25))
+	rT := -2 * math.Sqrt(cBar7/(cBar7+pow25to7)) * math.Sin(2*dTheta*deg)
+
+	l, c, h := dL/sL, dC/sC, dH/sH
+	return math.Sqrt(l*l + c*c + h*h + rT*c*h)
+}
+
+// hue angle in degrees in [0, 360), or 0 for a neutral color
+func hueDegrees(a, b float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// Returns the code of the frontier color next to which to place x, timing the
+// search if the canvas collects statistics.
+func (c *Canvas) nearest(x SampledColor, color Color, code MortonCode) MortonCode {
+	if c.rerank != RerankNone {
+		return c.rerankNearest(x, color, code)
+	}
+	if c.stats == nil {
+		return c.tree.Nearest(color, code)
+	}
+	start := time.Now()
+	nearest := c.tree.Nearest(color, code)
+	c.stats.SearchTime += time.Since(start)
+	c.stats.Placed++
+	return nearest
+}
+
+// Returns the code of the nearest few frontier colors whose exact color
+// differs least from that of x. Each candidate code stands for the color of
+// the position at which it would be placed, since positions that share a code
+// may hold slightly different exact colors.
+func (c *Canvas) rerankNearest(x SampledColor, color Color, code MortonCode) MortonCode {
+	var start, searched time.Time
+	if c.stats != nil {
+		start = time.Now()
+	}
+	c.candidates = c.tree.NearestK(color, code, c.rerankK, c.candidates[:0])
+	if c.stats != nil {
+		searched = time.Now()
+	}
+	q := c.rerank.lab(x.rgb)
+	best, bestDeltaE, baseDeltaE := 0, math.Inf(1), 0.0
+	for i, cand := range c.candidates {
+		deltaE := c.rerank.deltaE(q, c.rerank.lab(c.rgb[c.positions[cand].arbitrary()]))
+		if i == 0 {
+			baseDeltaE = deltaE
+		}
+		if deltaE < bestDeltaE {
+			best, bestDeltaE = i, deltaE
+		}
+	}
+	if s := c.stats; s != nil {
+		s.SearchTime += searched.Sub(start)
+		s.RerankTime += time.Since(searched)
+		s.Placed++
+		s.BaseDeltaE += baseDeltaE
+		s.DeltaE += bestDeltaE
+		if best != 0 {
+			s.Changed++
+		}
+	}
+	return c.candidates[best]
+}
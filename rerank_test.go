@@ -0,0 +1,63 @@
+package pix
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCIEDE2000(t *testing.T) {
+	// pairs from the supplementary test data of Sharma, Wu and Dalal, which
+	// include the edge cases in the mean hue around the discontinuity at 180°
+	tests := []struct {
+		p, q   [3]float64
+		deltaE float64
+	}{
+		{[3]float64{50, 2.6772, -79.7751}, [3]float64{50, 0, -82.7485}, 2.0425},
+		{[3]float64{50, 3.1571, -77.2803}, [3]float64{50, 0, -82.7485}, 2.8615},
+		{[3]float64{50, 0, 0}, [3]float64{50, -1, 2}, 2.3669},
+		{[3]float64{50, -1, 2}, [3]float64{50, 0, 0}, 2.3669},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.0009}, 7.1792},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.001}, 7.1792},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.0011}, 7.2195},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.0012}, 7.2195},
+		{[3]float64{50, -0.001, 2.49}, [3]float64{50, 0.0009, -2.49}, 4.8045},
+		{[3]float64{50, -0.001, 2.49}, [3]float64{50, 0.0011, -2.49}, 4.7461},
+		{[3]float64{50, 2.5, 0}, [3]float64{50, 0, -2.5}, 4.3065},
+		{[3]float64{50, 2.5, 0}, [3]float64{73, 25, -18}, 27.1492},
+		{[3]float64{50, 2.5, 0}, [3]float64{61, -5, 29}, 22.8977},
+		{[3]float64{50, 2.5, 0}, [3]float64{56, -27, -3}, 31.9030},
+		{[3]float64{50, 2.5, 0}, [3]float64{58, 24, 15}, 19.4535},
+		{[3]float64{50, 2.5, 0}, [3]float64{50, 3.1736, 0.5854}, 1.0000},
+		{[3]float64{50, 2.5, 0}, [3]float64{50, 3.2972, 0}, 1.0000},
+		{[3]float64{50, 2.5, 0}, [3]float64{50, 1.8634, 0.5757}, 1.0000},
+		{[3]float64{50, 2.5, 0}, [3]float64{50, 3.2592, 0.3350}, 1.0000},
+		{[3]float64{60.2574, -34.0099, 36.2677}, [3]float64{60.4626, -34.1751, 39.4387}, 1.2644},
+		{[3]float64{22.7233, 20.0904, -46.6940}, [3]float64{23.0331, 14.9730, -42.5619}, 2.0373},
+	}
+	for _, test := range tests {
+		if got := ciede2000(test.p, test.q); math.Abs(got-test.deltaE) > 5e-5 {
+			t.Errorf("ΔE between %v and %v: got %.4f; want %.4f", test.p, test.q, got, test.deltaE)
+		}
+	}
+}
+
+func TestRerank(t *testing.T) {
+	w, h := 40, 30
+	_, colors := randomPalette(t, 500, w*h)
+
+	for _, rerank := range []Rerank{RerankOkLab, RerankCIEDE2000} {
+		stats := &PlaceStats{}
+		canvas := placeAll(t, colors, Options{Width: w, Height: h, Rerank: rerank, Stats: stats})
+		// every color but the seed is placed by search
+		if stats.Placed != len(colors)-1 {
+			t.Errorf("rerank %v: placed %v colors; want %v", rerank, stats.Placed, len(colors)-1)
+		}
+		if stats.Changed == 0 || !(stats.DeltaE < stats.BaseDeltaE) {
+			t.Errorf("rerank %v: re-ranking changed %v matches, from total ΔE %v to %v",
+				rerank, stats.Changed, stats.BaseDeltaE, stats.DeltaE)
+		}
+		if canvas.exact {
+			t.Errorf("rerank %v: tracking exact colors for re-ranking also writes them", rerank)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package pix
+
+import "math"
+
+// A Weighting determines how likely each source pixel is to be sampled
+// based on the image content around it, so that small but striking details
+// aren't drowned out by large flat areas like sky and walls.
+type Weighting int
+
+const (
+	// Weight every pixel equally
+	WeightingUniform Weighting = iota
+	// Weight pixels by local contrast: the magnitude of the Sobel
+	// gradient of the image in OkLab
+	WeightingEdges
+	// Weight pixels by a simple saliency estimate: the OkLab distance
+	// between the pixel's slightly blurred color and the mean image color
+	WeightingSaliency
+)
+
+// Returns a weight for each source pixel, normalized to a mean of 1, or nil if
+// the weighting is uniform. uniformMix blends the weights with uniform sampling,
+// from 0 (purely content-weighted) to 1 (uniform).
+func contentWeights(src []ImageColor, weighting Weighting, uniformMix float64) []float64 {
+	if weighting == WeightingUniform || uniformMix >= 1 {
+		return nil
+	}
+
+	// lay the source out on a grid; it may have holes, eg. where transparent pixels were skipped
+	minX, minY, maxX, maxY := sourceBounds(src)
+	w, h := maxX-minX+1, maxY-minY+1
+	grid := make([]int32, w*h)
+	for i := range grid {
+		grid[i] = -1
+	}
+	lab := make([][3]float32, len(src))
+	for i, c := range src {
+		grid[(c.Y-minY)*w+c.X-minX] = int32(i)
+		L, a, b := linear_srgb_to_oklab(toLinearRGB(c.R, 0xffff), toLinearRGB(c.G, 0xffff), toLinearRGB(c.B, 0xffff))
+		lab[i] = [3]float32{float32(L), float32(a), float32(b)}
+	}
+	// returns the index of the source pixel at (x, y) in grid coordinates, or -1
+	at := func(x, y int) int32 {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return -1
+		}
+		return grid[y*w+x]
+	}
+
+	scores := make([]float64, len(src))
+	switch weighting {
+	case WeightingEdges:
+		for i, c := range src {
+			x, y := c.X-minX, c.Y-minY
+			// missing neighbors take the center color, so holes and image borders don't read as edges
+			get := func(dx, dy int) [3]float32 {
+				if j := at(x+dx, y+dy); j >= 0 {
+					return lab[j]
+				}
+				return lab[i]
+			}
+			var sum float64
+			for ch := 0; ch < 3; ch++ {
+				gx := get(1, -1)[ch] + 2*get(1, 0)[ch] + get(1, 1)[ch] - get(-1, -1)[ch] - 2*get(-1, 0)[ch] - get(-1, 1)[ch]
+				gy := get(-1, 1)[ch] + 2*get(0, 1)[ch] + get(1, 1)[ch] - get(-1, -1)[ch] - 2*get(0, -1)[ch] - get(1, -1)[ch]
+				sum += float64(gx*gx + gy*gy)
+			}
+			scores[i] = math.Sqrt(sum)
+		}
+	case WeightingSaliency:
+		// frequency-tuned saliency (Achanta et al. 2009), with a 5x5 box blur
+		var mean [3]float64
+		for _, c := range lab {
+			for ch := range c {
+				mean[ch] += float64(c[ch])
+			}
+		}
+		for ch := range mean {
+			mean[ch] /= float64(len(lab))
+		}
+		const r = 2
+		for i, c := range src {
+			x, y := c.X-minX, c.Y-minY
+			var blur [3]float64
+			n := 0
+			for dy := -r; dy <= r; dy++ {
+				for dx := -r; dx <= r; dx++ {
+					if j := at(x+dx, y+dy); j >= 0 {
+						for ch := range blur {
+							blur[ch] += float64(lab[j][ch])
+						}
+						n++
+					}
+				}
+			}
+			var sum float64
+			for ch := range blur {
+				d := blur[ch]/float64(n) - mean[ch]
+				sum += d * d
+			}
+			scores[i] = math.Sqrt(sum)
+		}
+	default:
+		panic("contentWeights: unknown weighting")
+	}
+
+	// mix the score distribution with the uniform distribution
+	var total float64
+	for _, s := range scores {
+		total += s
+	}
+	if !(total > 0) {
+		return nil // a flat image has nothing to emphasize
+	}
+	mean := total / float64(len(scores))
+	for i, s := range scores {
+		scores[i] = uniformMix + (1-uniformMix)*s/mean
+	}
+	return scores
+}
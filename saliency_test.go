@@ -0,0 +1,46 @@
+package pix
+
+import "testing"
+
+func TestContentWeighting(t *testing.T) {
+	// a 16x16 gray source with a small red detail in the middle
+	var src []ImageColor
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			c := ImageColor{x, y, 0x8080, 0x8080, 0x8080}
+			if x >= 7 && x < 9 && y >= 7 && y < 9 {
+				c.G, c.B = 0, 0
+			}
+			src = append(src, c)
+		}
+	}
+	isRed := func(c SampledColor) bool { return c.rgb.y == 0 }
+
+	// the detail covers 1/64 of the source, but content weighting samples it far more often
+	for _, weighting := range []Weighting{WeightingEdges, WeightingSaliency} {
+		nRed := 0
+		for _, c := range mustSampleColors(t, src, 64, SampleOptions{Weighting: weighting, Strategy: StrategyStratified}) {
+			if isRed(c) {
+				nRed++
+			}
+		}
+		if nRed < 4 {
+			t.Errorf("weighting %v: got %v red colors of 64; want at least 4", weighting, nRed)
+		}
+	}
+
+	// mixing in uniform sampling entirely gives the unweighted result
+	got := mustSampleColors(t, src, 64, SampleOptions{Weighting: WeightingEdges, UniformMix: 1})
+	want := mustSampleColors(t, src, 64, SampleOptions{})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("uniform mix: got %v; want %v", got, want)
+		}
+	}
+
+	// a flat region is sampled uniformly rather than not at all
+	flat := src[:16]
+	if colors := mustSampleColors(t, flat, 4, SampleOptions{Weighting: WeightingSaliency}); len(colors) != 4 {
+		t.Errorf("got %v colors from a flat source; want 4", len(colors))
+	}
+}
@@ -0,0 +1,521 @@
+package pix
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// A Strategy determines how colors are chosen when there are
+// more source pixels than colors to sample.
+type Strategy int
+
+const (
+	// Take every k-th pixel in row-major order
+	StrategyRowMajor Strategy = iota
+	// Take one randomly chosen pixel from each cell of a grid over the source.
+	// The grid has one cell per color, each holding an equal share of the
+	// pixels, laid out in horizontal bands of roughly square cells.
+	StrategyStratified
+	// Take pixels uniformly at random, without replacement
+	StrategyRandom
+	// Average the pixels within each cell of the grid used by StrategyStratified,
+	// a box filter
+	StrategyAreaAverage
+)
+
+type SampleOptions struct {
+	// Quantize OkLab to 10 bits per channel, computed from the full 16-bit
+	// source colors, rather than 8. The canvas must use the same precision.
+	HighPrecision bool
+	// Strategy for downsampling the source
+	Strategy Strategy
+	// Random seed for the stratified and random strategies
+	Seed int64
+	// When upsampling, repeat each source pixel either floor(n) or ceil(n) times,
+	// where n is the ratio of colors to source pixels, spreading the extra repetitions
+	// evenly across the source. By default each pixel is repeated floor(n) times
+	// and the remainder is topped up from the start of the source.
+	EvenUpsampling bool
+	// If set, restricts sampling to the pixels with nonzero weight under the mask,
+	// with the chance of sampling each proportional to its weight. Sampling fails
+	// if the mask leaves no pixels. SampleSources uses each Source's Mask instead.
+	Mask *Mask
+	// Weight source pixels by their content, multiplying any mask weights
+	Weighting Weighting
+	// Blend the content weighting with uniform sampling, from 0 (the default,
+	// purely content-weighted) to 1 (uniform)
+	UniformMix float64
+	// If set, OkLab colors are quantized with this transform rather than the
+	// fixed range spanning the sRGB gamut. See FitOkLab and FitOkLabPalette.
+	OkLab *OkLabTransform
+}
+
+// Samples nPixels colors from the source pixels, which need not form a full
+// rectangle. Returns an error if there are no pixels to sample from, including
+// when opts.Mask excludes every pixel.
+func SampleColors(src []ImageColor, nPixels int, opts SampleOptions) ([]SampledColor, error) {
+	if len(src) == 0 {
+		return nil, fmt.Errorf("the source has no pixels")
+	}
+	ret := make([]SampledColor, nPixels)
+	src, weights := weightSource(src, opts.Mask, opts)
+	if len(src) == 0 {
+		return nil, fmt.Errorf("the source has no pixels with nonzero mask weight")
+	}
+	// center the hilbert curve in its power-of-2 bounding box so as
+	// not to unduly privilege one corner of the image over the others.
+	// the source need not be a full rectangle (eg. if transparent pixels
+	// were skipped, or it was cropped or masked) so we compute its extent
+	// from the bounding box.
+	minX, minY, maxX, maxY := sourceBounds(src)
+	srcW, srcH := maxX-minX, maxY-minY
+	if err := checkVirtualSize(srcW+1, srcH+1); err != nil {
+		return nil, err
+	}
+	wOffset := int((pow2MoreThan(srcW)-uint32(srcW))/2) - minX
+	hOffset := int((pow2MoreThan(srcH)-uint32(srcH))/2) - minY
+	sampleInto(ret, src, weights, 0, 0, wOffset, hOffset, opts)
+	return ret, nil
+}
+
+// A Source is one of several images contributing colors to a palette,
+// with a weight that determines its share of the sampled colors and
+// an optional mask that weights its pixels; see SampleOptions.Mask.
+type Source struct {
+	Colors []ImageColor
+	Weight float64
+	Mask   *Mask
+}
+
+// Samples nPixels colors from multiple sources, each contributing a number
+// of colors proportional to its weight. In order to keep image-space sorting
+// meaningful, Hilbert codes are computed as if the sources were laid out
+// side by side, left to right and vertically centered, in one virtual image.
+func SampleSources(srcs []Source, nPixels int, opts SampleOptions) ([]SampledColor, error) {
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("no sources to sample from")
+	}
+	weights := make([]float64, len(srcs))
+	masked := make([]Source, len(srcs))
+	pixelWeights := make([][]float64, len(srcs))
+	for i, src := range srcs {
+		if src.Weight < 0 {
+			return nil, fmt.Errorf("source %v has negative weight %v", i, src.Weight)
+		}
+		if len(src.Colors) == 0 && src.Weight > 0 {
+			return nil, fmt.Errorf("source %v has no colors", i)
+		}
+		if src.Mask != nil && len(src.Colors) > 0 {
+			_, _, maxX, maxY := sourceBounds(src.Colors)
+			if w, h := src.Mask.Size(); maxX >= w || maxY >= h {
+				return nil, fmt.Errorf("source %v is larger than its %vx%v mask", i, w, h)
+			}
+		}
+		masked[i] = src
+		masked[i].Colors, pixelWeights[i] = weightSource(src.Colors, src.Mask, opts)
+		if len(masked[i].Colors) == 0 && src.Weight > 0 {
+			return nil, fmt.Errorf("source %v has no pixels with nonzero mask weight", i)
+		}
+		weights[i] = src.Weight
+	}
+	srcs = masked
+	counts, err := apportion(weights, nPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	// lay the sources out in the virtual image, skipping those that contribute nothing
+	type placement struct{ minX, minY, left, h int }
+	placements := make([]placement, len(srcs))
+	var virtualW, virtualH int
+	for i, src := range srcs {
+		if counts[i] == 0 {
+			continue
+		}
+		minX, minY, maxX, maxY := sourceBounds(src.Colors)
+		w, h := maxX-minX+1, maxY-minY+1
+		placements[i] = placement{minX, minY, virtualW, h}
+		virtualW += w
+		if h > virtualH {
+			virtualH = h
+		}
+	}
+	if err := checkVirtualSize(virtualW, virtualH); err != nil {
+		return nil, err
+	}
+	// center the hilbert curve in its power-of-2 bounding box; see SampleColors
+	srcW, srcH := virtualW-1, virtualH-1
+	wOffset := int((pow2MoreThan(srcW) - uint32(srcW)) / 2)
+	hOffset := int((pow2MoreThan(srcH) - uint32(srcH)) / 2)
+
+	ret := make([]SampledColor, nPixels)
+	start := 0
+	for i, src := range srcs {
+		if counts[i] == 0 {
+			continue
+		}
+		p := placements[i]
+		top := (virtualH - p.h) / 2
+		dst := ret[start : start+counts[i]]
+		srcOpts := opts
+		srcOpts.Seed += int64(i) // decorrelate random choices across sources
+		sampleInto(dst, src.Colors, pixelWeights[i], p.left-p.minX, top-p.minY, wOffset, hOffset, srcOpts)
+		start += counts[i]
+	}
+	return ret, nil
+}
+
+// The largest width and height of the (virtual) source image, whose
+// coordinates have 16 bits each in the Hilbert codes of sampled colors
+const maxVirtualSize = 1 << 16
+
+func checkVirtualSize(w, h int) error {
+	if w > maxVirtualSize || h > maxVirtualSize {
+		return fmt.Errorf("the sources span %vx%v pixels; the largest supported extent is %v", w, h, maxVirtualSize)
+	}
+	return nil
+}
+
+// Returns the pixels of src with nonzero weight under the mask and content
+// weighting along with their weights, or src and nil weights if sampling is
+// uniform. If the content weighting leaves no pixels within the mask (eg. when
+// it selects a flat region and UniformMix is zero) the mask is used alone.
+func weightSource(src []ImageColor, mask *Mask, opts SampleOptions) ([]ImageColor, []float64) {
+	if len(src) == 0 {
+		return src, nil
+	}
+	content := contentWeights(src, opts.Weighting, opts.UniformMix)
+	if mask == nil && content == nil {
+		return src, nil
+	}
+	kept := make([]ImageColor, 0, len(src))
+	weights := make([]float64, 0, len(src))
+	for i, c := range src {
+		w := 1.0
+		if mask != nil {
+			w = mask.Weight(c.X, c.Y)
+		}
+		if content != nil {
+			w *= content[i]
+		}
+		if w > 0 {
+			kept = append(kept, c)
+			weights = append(weights, w)
+		}
+	}
+	if len(kept) == 0 && content != nil {
+		opts.Weighting = WeightingUniform
+		return weightSource(src, mask, opts)
+	}
+	return kept, weights
+}
+
+// Fill ret with colors sampled from src, whose coordinates are translated
+// by (dx, dy) to give the positions of the sampled colors in the virtual image
+// of SampleSources, and by a further (wOffset, hOffset) before computing their
+// Hilbert codes. If weights is non-nil, it holds a positive sampling weight for
+// each source pixel.
+func sampleInto(ret []SampledColor, src []ImageColor, weights []float64, dx, dy, wOffset, hOffset int, opts SampleOptions) {
+	nSrc, nDst := len(src), len(ret)
+	xyCode := func(c ImageColor) uint32 {
+		return xyToHilbert(uint32(c.X+dx+wOffset), uint32(c.Y+dy+hOffset), 16)
+	}
+	sample := func(c ImageColor) SampledColor {
+		code := xyCode(c)
+		c.X, c.Y = c.X+dx, c.Y+dy
+		return sampleColor(c, code, opts)
+	}
+	if weights != nil {
+		sampleWeighted(ret, src, weights, sample, opts)
+		return
+	}
+	if nDst < nSrc {
+		switch opts.Strategy {
+		case StrategyStratified, StrategyAreaAverage:
+			// order the source by grid cell, then split it into nDst strata
+			order := gridOrder(src, nil, nDst)
+			rng := rand.New(rand.NewSource(opts.Seed))
+			for i := 0; i < nDst; i++ {
+				lo, hi := i*nSrc/nDst, (i+1)*nSrc/nDst
+				stratum := order[lo:hi]
+				if opts.Strategy == StrategyStratified {
+					ret[i] = sample(src[stratum[rng.Intn(len(stratum))]])
+				} else {
+					ret[i] = sample(averageColor(src, stratum, nil))
+				}
+			}
+		case StrategyRandom:
+			// partial fisher-yates shuffle, sorted afterwards to preserve the source order
+			rng := rand.New(rand.NewSource(opts.Seed))
+			perm := make([]int32, nSrc)
+			for i := range perm {
+				perm[i] = int32(i)
+			}
+			for i := 0; i < nDst; i++ {
+				j := i + rng.Intn(nSrc-i)
+				perm[i], perm[j] = perm[j], perm[i]
+			}
+			chosen := perm[:nDst]
+			sort.Slice(chosen, func(i, j int) bool { return chosen[i] < chosen[j] })
+			for i, index := range chosen {
+				ret[i] = sample(src[index])
+			}
+		default:
+			// do expensive stuff once per dst
+			for i := 0; i < nDst; i++ {
+				pc := float64(i) / float64(nDst)
+				index := int(float64(nSrc) * pc)
+				ret[i] = sample(src[index])
+			}
+		}
+	} else if opts.EvenUpsampling {
+		// source pixel i is repeated for output indices [i*nDst/nSrc, (i+1)*nDst/nSrc)
+		for i, c := range src {
+			x := sample(c)
+			for j := i * nDst / nSrc; j < (i+1)*nDst/nSrc; j++ {
+				ret[j] = x
+			}
+		}
+	} else {
+		nMultiples := nDst / nSrc
+		index := 0
+		for _, c := range src {
+			x := sample(c)
+			for s := 0; s < nMultiples; s++ {
+				ret[index] = x
+				index++
+			}
+		}
+		nPlaced := nSrc * nMultiples
+		nRemaining := nDst - nPlaced
+		for i := 0; i < nRemaining; i++ {
+			pc := float64(i) / float64(nRemaining)
+			index := int(float64(nSrc) * pc)
+			ret[nPlaced+i] = ret[index]
+		}
+	}
+}
+
+// Like sampleInto, but chooses pixels with probability proportional to their
+// weights. Picture the pixels laid end to end along a line, each occupying
+// a length equal to its weight, and the line divided into nDst equal strata.
+// Each strategy then picks from the strata as it does from the equally sized
+// strata of the unweighted case, and upsampling repeats each pixel in
+// proportion to its weight.
+func sampleWeighted(ret []SampledColor, src []ImageColor, weights []float64, sample func(ImageColor) SampledColor, opts SampleOptions) {
+	nSrc, nDst := len(src), len(ret)
+	rng := rand.New(rand.NewSource(opts.Seed))
+	downsampling := nDst < nSrc
+
+	if downsampling && opts.Strategy == StrategyRandom {
+		// weighted sampling without replacement (Efraimidis and Spirakis): give each
+		// pixel an exponential key with rate equal to its weight and take the smallest
+		keys := make([]float64, nSrc)
+		order := make([]int32, nSrc)
+		for i, w := range weights {
+			keys[i] = rng.ExpFloat64() / w
+			order[i] = int32(i)
+		}
+		sort.Slice(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+		chosen := order[:nDst]
+		sort.Slice(chosen, func(i, j int) bool { return chosen[i] < chosen[j] })
+		for i, index := range chosen {
+			ret[i] = sample(src[index])
+		}
+		return
+	}
+
+	var order []int32
+	if downsampling && (opts.Strategy == StrategyStratified || opts.Strategy == StrategyAreaAverage) {
+		order = gridOrder(src, weights, nDst)
+	} else {
+		order = make([]int32, nSrc)
+		for i := range order {
+			order[i] = int32(i)
+		}
+	}
+	// cum[j] is the position along the line at which the j-th pixel in order starts
+	cum := make([]float64, nSrc+1)
+	for j, index := range order {
+		cum[j+1] = cum[j] + weights[index]
+	}
+	stratum := cum[nSrc] / float64(nDst)
+	// returns the pixel covering position t along the line
+	at := func(t float64) ImageColor {
+		j := sort.Search(nSrc, func(j int) bool { return cum[j+1] > t })
+		if j == nSrc {
+			j = nSrc - 1
+		}
+		return src[order[j]]
+	}
+	for i := 0; i < nDst; i++ {
+		start := float64(i) * stratum
+		switch {
+		case downsampling && opts.Strategy == StrategyStratified:
+			ret[i] = sample(at(start + rng.Float64()*stratum))
+		case downsampling && opts.Strategy == StrategyAreaAverage:
+			// average the pixels whose midpoints lie in the stratum; a heavy pixel
+			// may swallow a stratum whole, in which case we take it alone
+			lo := sort.Search(nSrc, func(j int) bool { return cum[j]+cum[j+1] >= 2*start })
+			hi := sort.Search(nSrc, func(j int) bool { return cum[j]+cum[j+1] >= 2*(start+stratum) })
+			if lo == hi {
+				ret[i] = sample(at(start + stratum/2))
+			} else {
+				ret[i] = sample(averageColor(src, order[lo:hi], weights))
+			}
+		default:
+			ret[i] = sample(at(start + stratum/2))
+		}
+	}
+}
+
+// Returns the indices of the source pixels ordered so that splitting them into
+// n runs of equal total weight gives the cells of a grid. The pixels are split
+// into horizontal bands, each holding the pixels of a whole number of cells
+// in row-major order, and each band is ordered by column. The number of bands
+// makes the cells roughly square if the pixels are spread evenly over their
+// bounding box. Pixels have unit weight if weights is nil; otherwise a pixel
+// belongs to the band that holds the midpoint of its weight.
+func gridOrder(src []ImageColor, weights []float64, n int) []int32 {
+	order := make([]int32, len(src))
+	for i := range order {
+		order[i] = int32(i)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := src[order[i]], src[order[j]]
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+	var total float64
+	for _, i := range order {
+		if weights != nil {
+			total += weights[i]
+		}
+	}
+
+	minX, minY, maxX, maxY := sourceBounds(src)
+	w, h := float64(maxX-minX+1), float64(maxY-minY+1)
+	nBands := int(math.Round(h / math.Sqrt(w*h/float64(n))))
+	if nBands < 1 {
+		nBands = 1
+	} else if nBands > n {
+		nBands = n
+	}
+	// band b holds cells [b*n/nBands, (b+1)*n/nBands)
+	start, cum := 0, 0.0
+	for b := 0; b < nBands; b++ {
+		end := len(order)
+		if b < nBands-1 && weights == nil {
+			// the boundary between strata of sampleInto
+			end = (b + 1) * n / nBands * len(order) / n
+		} else if b < nBands-1 {
+			limit := float64((b+1)*n/nBands) / float64(n) * total
+			for end = start; end < len(order) && cum+weights[order[end]]/2 < limit; end++ {
+				cum += weights[order[end]]
+			}
+		}
+		band := order[start:end]
+		sort.Slice(band, func(i, j int) bool {
+			a, b := src[band[i]], src[band[j]]
+			return a.X < b.X || a.X == b.X && a.Y < b.Y
+		})
+		start = end
+	}
+	return order
+}
+
+// Returns the average of the source colors at the given indices, positioned
+// at the middle one of them. Colors are averaged in linear RGB, weighted
+// by weights if it is non-nil.
+func averageColor(src []ImageColor, indices []int32, weights []float64) ImageColor {
+	var r, g, b, n float64
+	for _, i := range indices {
+		c := src[i]
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		r += w * toLinearRGB(c.R, 0xffff)
+		g += w * toLinearRGB(c.G, 0xffff)
+		b += w * toLinearRGB(c.B, 0xffff)
+		n += w
+	}
+	c := src[indices[len(indices)/2]]
+	return ImageColor{c.X, c.Y, toNonlinearRGB16(r / n), toNonlinearRGB16(g / n), toNonlinearRGB16(b / n)}
+}
+
+func sampleColor(c ImageColor, xyCode uint32, opts SampleOptions) SampledColor {
+	rgb := Color{c.R >> 8, c.G >> 8, c.B >> 8}
+	var lab Color
+	if opts.OkLab != nil {
+		max, shift := codeMax(opts.HighPrecision), uint(8)
+		if opts.HighPrecision {
+			shift = 0
+		}
+		L, a, b := linear_srgb_to_oklab(
+			toLinearRGB(c.R>>shift, 0xffff>>shift),
+			toLinearRGB(c.G>>shift, 0xffff>>shift),
+			toLinearRGB(c.B>>shift, 0xffff>>shift))
+		lab = opts.OkLab.quantize(L, a, b, max)
+	} else if opts.HighPrecision {
+		lab = rgb16ToOkLab(c.R, c.G, c.B)
+	} else {
+		lab = rgbToOkLab(rgb)
+	}
+	rgbCode := mortonCode(rgb.x, rgb.y, rgb.z)
+	labCode := mortonCode(lab.x, lab.y, lab.z)
+	return SampledColor{rgb, lab, rgbCode, labCode, xyCode, int32(c.X), int32(c.Y)}
+}
+
+// Split n into integer parts proportional to the weights using the largest remainder method.
+func apportion(weights []float64, n int) ([]int, error) {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if !(total > 0) {
+		return nil, fmt.Errorf("weights must sum to a positive number")
+	}
+	counts := make([]int, len(weights))
+	remainders := make([]float64, len(weights))
+	assigned := 0
+	for i, w := range weights {
+		share := float64(n) * w / total
+		counts[i] = int(share)
+		remainders[i] = share - float64(counts[i])
+		assigned += counts[i]
+	}
+	// hand out the leftovers to the parts with the largest fractional remainders
+	var order []int
+	for i, w := range weights {
+		if w > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for i := 0; assigned < n; i++ {
+		counts[order[i%len(order)]]++
+		assigned++
+	}
+	return counts, nil
+}
+
+// returns the inclusive bounding box of the source pixel coordinates
+func sourceBounds(src []ImageColor) (minX, minY, maxX, maxY int) {
+	minX, minY = src[0].X, src[0].Y
+	maxX, maxY = minX, minY
+	for _, c := range src[1:] {
+		if c.X < minX {
+			minX = c.X
+		} else if c.X > maxX {
+			maxX = c.X
+		}
+		if c.Y < minY {
+			minY = c.Y
+		} else if c.Y > maxY {
+			maxY = c.Y
+		}
+	}
+	return
+}
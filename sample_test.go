@@ -0,0 +1,201 @@
+package pix
+
+import (
+	"image"
+	"testing"
+)
+
+func TestApportion(t *testing.T) {
+	tests := []struct {
+		weights []float64
+		n       int
+		want    []int
+	}{
+		{[]float64{1}, 10, []int{10}},
+		{[]float64{50, 30, 20}, 10, []int{5, 3, 2}},
+		{[]float64{1, 1, 1}, 10, []int{4, 3, 3}},
+		{[]float64{1, 0, 2}, 7, []int{2, 0, 5}},
+		{[]float64{0, 1}, 3, []int{0, 3}},
+	}
+	for _, test := range tests {
+		got, err := apportion(test.weights, test.n)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test, err)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v; want %v", test, got, test.want)
+				break
+			}
+		}
+	}
+	if _, err := apportion([]float64{0, 0}, 10); err == nil {
+		t.Errorf("expected an error for zero total weight")
+	}
+}
+
+func TestSampleSources(t *testing.T) {
+	solid := func(w, h int, v uint16) []ImageColor {
+		var colors []ImageColor
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				colors = append(colors, ImageColor{x, y, v, v, v})
+			}
+		}
+		return colors
+	}
+	a, b := solid(4, 4, 0), solid(4, 4, 0xffff)
+
+	// a single source is sampled exactly as by SampleColors
+	got, err := SampleSources([]Source{{a, 1, nil}}, 10, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustSampleColors(t, a, 10, SampleOptions{})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("single source: got %v; want %v", got, want)
+		}
+	}
+
+	// sources contribute colors in proportion to their weights, and
+	// the second source lies entirely to the right of the first
+	got, err = SampleSources([]Source{{a, 3, nil}, {b, 1, nil}}, 16, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nBlack := 0
+	for _, c := range got {
+		if c.rgb.x == 0 {
+			nBlack++
+		}
+	}
+	if nBlack != 12 {
+		t.Errorf("got %v colors from the first source; want 12", nBlack)
+	}
+	for _, c := range got {
+		x, _ := hilbertToXY(c.xyCode, 16)
+		if (c.rgb.x == 0) != (x < 4) {
+			t.Errorf("color %v at virtual x=%v is not in its source's half of the virtual image", c.rgb, x)
+		}
+		if (c.rgb.x == 0) != (c.x < 4) {
+			t.Errorf("color %v has x=%v, which is not in its source's half of the virtual image", c.rgb, c.x)
+		}
+	}
+
+	if _, err := SampleSources([]Source{{a, -1, nil}}, 16, SampleOptions{}); err == nil {
+		t.Errorf("expected an error for a negative weight")
+	}
+
+	// the virtual image can be at most 65536 pixels wide, so that its
+	// coordinates fit in the 16 bits per axis of the Hilbert codes
+	wide := func(w int) []ImageColor { return []ImageColor{{0, 0, 0, 0, 0}, {w - 1, 0, 0, 0, 0}} }
+	if _, err := SampleSources([]Source{{wide(32768), 1, nil}, {wide(32768), 1, nil}}, 4, SampleOptions{}); err != nil {
+		t.Errorf("unexpected error for a virtual image 65536 pixels wide: %v", err)
+	}
+	if _, err := SampleSources([]Source{{wide(30000), 1, nil}, {wide(30000), 1, nil}, {wide(30000), 1, nil}}, 4, SampleOptions{}); err == nil {
+		t.Errorf("expected an error for a virtual image 90000 pixels wide")
+	}
+}
+
+func TestSampleStrategies(t *testing.T) {
+	// a 4x4 source whose quadrants are solid black, red, green and blue
+	quadrant := []uint16{0, 0, 0, 0xffff, 0, 0, 0, 0xffff, 0, 0, 0, 0xffff}
+	var src []ImageColor
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			q := 3 * (2*(y/2) + x/2)
+			src = append(src, ImageColor{x, y, quadrant[q], quadrant[q+1], quadrant[q+2]})
+		}
+	}
+
+	// stratified sampling and area averaging take one color from each quadrant
+	for _, strategy := range []Strategy{StrategyStratified, StrategyAreaAverage} {
+		colors := mustSampleColors(t, src, 4, SampleOptions{Strategy: strategy, Seed: 1})
+		seen := make(map[Color]bool)
+		for _, c := range colors {
+			seen[c.rgb] = true
+		}
+		if len(seen) != 4 {
+			t.Errorf("strategy %v: got colors %v; want one from each quadrant", strategy, colors)
+		}
+	}
+
+	// the strata are the cells of a grid even when the source is not square and
+	// the ratio of pixels to colors is not a power of 4, with or without weights:
+	// a 6x4 source made of solid 2x2 blocks gives one color from each block
+	src = nil
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 6; x++ {
+			v := uint16(x/2+3*(y/2)) * 0x2000
+			src = append(src, ImageColor{x, y, v, 0xffff - v, v})
+		}
+	}
+	white := image.NewGray(image.Rect(0, 0, 6, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 255
+	}
+	for _, mask := range []*Mask{nil, NewMask(white)} {
+		for _, strategy := range []Strategy{StrategyStratified, StrategyAreaAverage} {
+			colors := mustSampleColors(t, src, 6, SampleOptions{Strategy: strategy, Seed: 1, Mask: mask})
+			seen := make(map[Color]bool)
+			for _, c := range colors {
+				seen[c.rgb] = true
+			}
+			if len(seen) != 6 {
+				t.Errorf("strategy %v, mask %v: got colors %v; want one from each block", strategy, mask != nil, colors)
+			}
+		}
+	}
+
+	// random sampling is reproducible and never picks the same pixel twice
+	a := mustSampleColors(t, src, 8, SampleOptions{Strategy: StrategyRandom, Seed: 1})
+	b := mustSampleColors(t, src, 8, SampleOptions{Strategy: StrategyRandom, Seed: 1})
+	positions := make(map[uint32]bool)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("random sampling with the same seed gave different results")
+			break
+		}
+		if positions[a[i].xyCode] {
+			t.Errorf("random sampling picked position %v twice", a[i].xyCode)
+		}
+		positions[a[i].xyCode] = true
+	}
+
+	// even upsampling repeats every source color either once or twice
+	colors := mustSampleColors(t, src, 24, SampleOptions{EvenUpsampling: true})
+	counts := make(map[uint32]int)
+	for _, c := range colors {
+		counts[c.xyCode]++
+	}
+	for code, n := range counts {
+		if n < 1 || n > 2 {
+			t.Errorf("position %v was sampled %v times; want 1 or 2", code, n)
+		}
+	}
+	if len(counts) != len(src) {
+		t.Errorf("got %v distinct positions; want %v", len(counts), len(src))
+	}
+}
+
+func TestSampleColorsErrors(t *testing.T) {
+	// eg. an image whose pixels were all below the alpha threshold
+	if _, err := SampleColors(nil, 4, SampleOptions{}); err == nil {
+		t.Errorf("expected an error for a source with no pixels")
+	}
+	src := []ImageColor{{0, 0, 0, 0, 0}, {1, 0, 0xffff, 0xffff, 0xffff}}
+	if _, err := SampleColors(src, 4, SampleOptions{Mask: NewMask(image.NewGray(image.Rect(0, 0, 2, 1)))}); err == nil {
+		t.Errorf("expected an error for a mask that excludes every pixel")
+	}
+}
+
+func mustSampleColors(t *testing.T, src []ImageColor, nPixels int, opts SampleOptions) []SampledColor {
+	t.Helper()
+	colors, err := SampleColors(src, nPixels, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return colors
+}
@@ -0,0 +1,323 @@
+package pix
+
+import (
+	"math"
+	"math/rand"
+)
+
+// A ColorCurve is a space-filling curve through 8-bit color space whose
+// order is used by the color term of the similarity sort.
+type ColorCurve int
+
+const (
+	// Morton (z-order) curve over sRGB, which is cheap but jumps
+	// between distant colors at octant boundaries
+	ColorCurveMortonRGB ColorCurve = iota
+	// Hilbert curve over sRGB, on which consecutive colors are always adjacent
+	ColorCurveHilbertRGB
+	// Morton curve over quantized OkLab
+	ColorCurveMortonOkLab
+	// Hilbert curve over quantized OkLab
+	ColorCurveHilbertOkLab
+)
+
+// Weights of the terms making up each color's sort score, each of which is normalized to [0, 1].
+type SortOptions struct {
+	Image, Color, Random float64
+	Reverse              bool
+	// Weights for OkLCh lightness, chroma and hue
+	Lightness, Chroma, Hue float64
+	// Angle in degrees at which hues start, counterclockwise unless HueReverse is set
+	HueStart   float64
+	HueReverse bool
+	// Curve along which the Color term orders colors
+	ColorCurve ColorCurve
+	// Weights for distance from the focus, angle around it, and position along Direction
+	Radial, Angular, Directional float64
+	// Focal point as a fraction of the extent of the source positions
+	FocusX, FocusY float64
+	// Sweep direction in degrees clockwise from left to right, from which angles are measured
+	Direction float64
+	// If set, the sort score, replacing the weights above
+	Expr *SortExpr
+	// Seed for the random term and the rand variable of Expr
+	Seed int64
+	// If non-empty, keys to sort by in turn, replacing Expr; Reverse makes every key descending
+	Keys []SortKey
+	// Window of the local shuffle after sorting, and the most places it then moves each color
+	ShuffleWindow, MaxDisplacement int
+}
+
+// A SortKey is one of the keys of a lexicographic sort. Negate the
+// expression to sort by the key in descending order.
+type SortKey struct {
+	Expr *SortExpr
+	// If positive, the key's range is split into this many bands, within which colors tie
+	Buckets int
+}
+
+func SortBySimilarity(colors []SampledColor, opts SortOptions) {
+	applyOrder(colors, SortOrder(colors, opts))
+}
+
+// Returns the order in which SortBySimilarity would arrange the colors
+// without reordering them: order[i] is the index of the color placed i-th.
+func SortOrder(colors []SampledColor, opts SortOptions) []uint32 {
+	if uint64(len(colors)) > math.MaxUint32 {
+		panic("SortOrder: too many colors")
+	}
+	order := make([]uint32, len(colors))
+	for i := range order {
+		order[i] = uint32(i)
+	}
+	scores := make([]float64, len(colors))
+	rng := rand.New(rand.NewSource(opts.Seed))
+	sortByOptions(colors, scores, order, opts, rng)
+	if opts.ShuffleWindow > 1 {
+		shuffleWindows(order, opts.ShuffleWindow, rng)
+	}
+	if opts.MaxDisplacement > 0 {
+		displace(scores, order, opts.MaxDisplacement, rng)
+	}
+	return order
+}
+
+// Sorts perm, which starts out as the identity, by the colors' sort scores.
+// scores holds the score of the color at each position of perm.
+func sortByOptions(colors []SampledColor, scores []float64, perm []uint32, opts SortOptions, rng *rand.Rand) {
+	rgbMax := float64(mortonCode(255, 255, 255))
+
+	// compute the smallest and largest Hilbert codes in order to
+	// properly normalize the XY component of the sort score
+	var _xyMax uint32 = 0 // compute over the codes actually used
+	var _xyMin uint32 = ^uint32(0)
+	for _, e := range colors {
+		if e.xyCode > _xyMax {
+			_xyMax = e.xyCode
+		}
+		if e.xyCode < _xyMin {
+			_xyMin = e.xyCode
+		}
+	}
+	xyMax := float64(_xyMax)
+	xyMin := float64(_xyMin)
+	xyDiff := xyMax - xyMin
+	if xyDiff == 0 {
+		// all colors share one position (eg. a single-color palette)
+		xyDiff = 1
+	}
+
+	order := 1.0
+	if opts.Reverse {
+		order = -1
+	}
+	if len(opts.Keys) > 0 || opts.Expr != nil {
+		bounds := sortBounds{xyMin: xyMin, xyDiff: xyDiff}
+		bounds.xMin, bounds.xDiff, bounds.yMin, bounds.yDiff = positionBounds(colors)
+		var vars [numSortVars]float64
+		if len(opts.Keys) == 0 {
+			for i, e := range colors {
+				scores[i] = order * opts.Expr.score(e, &bounds, &vars, rng)
+			}
+			sortByScore(scores, perm)
+			return
+		}
+		// sort stably by each key from last to first, as in an LSD radix sort
+		for k := len(opts.Keys) - 1; k >= 0; k-- {
+			key := opts.Keys[k]
+			for i, j := range perm {
+				scores[i] = order * key.Expr.score(colors[j], &bounds, &vars, rng)
+			}
+			if key.Buckets > 0 {
+				bucketScores(scores, key.Buckets)
+			}
+			stableSortByScore(scores, perm)
+		}
+		return
+	}
+
+	random := opts.Random > 0
+	lch := opts.Lightness != 0 || opts.Chroma != 0 || opts.Hue != 0
+	spatial := opts.Radial != 0 || opts.Angular != 0 || opts.Directional != 0
+	var sk spatialKeys
+	if spatial {
+		sk = newSpatialKeys(colors, opts)
+	}
+	for i, e := range colors {
+		rgb := float64(curveCode(e, opts.ColorCurve)) / rgbMax
+		xy := (float64(e.xyCode) - xyMin) / xyDiff
+		score := float64(opts.Image*xy + opts.Color*rgb)
+		if lch {
+			L, C, h := rgbToOkLCh(e.rgb)
+			score += opts.Lightness*L + opts.Chroma*C/maxOkLabChroma + opts.Hue*hueFrom(h, opts)/360
+		}
+		if spatial {
+			radius, angle, sweep := sk.keys(e)
+			score += opts.Radial*radius + opts.Angular*angle + opts.Directional*sweep
+		}
+		if random {
+			score += opts.Random * rng.Float64()
+		}
+		scores[i] = order * score
+	}
+	sortByScore(scores, perm)
+
+}
+
+// A sliding-window Fisher-Yates shuffle: swap each color with a random
+// one among the window colors starting at its position.
+func shuffleWindows(perm []uint32, window int, rng *rand.Rand) {
+	for i := range perm {
+		n := window
+		if rest := len(perm) - i; rest < n {
+			n = rest
+		}
+		j := i + rng.Intn(n)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+}
+
+// Randomly permutes colors such that none moves more than d places, by
+// stably sorting them by their index plus a random offset in [0, d+1).
+// Colors more than d places after a color have larger keys, and colors
+// more than d places before it have smaller ones.
+func displace(scores []float64, perm []uint32, d int, rng *rand.Rand) {
+	for i := range perm {
+		scores[i] = float64(i) + rng.Float64()*float64(d+1)
+	}
+	stableSortByScore(scores, perm)
+}
+
+// Replaces each sort score with the index of its band when the range
+// of scores is split into n equal bands.
+func bucketScores(scores []float64, n int) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range scores {
+		lo, hi = math.Min(lo, s), math.Max(hi, s)
+	}
+	width := (hi - lo) / float64(n)
+	for i, s := range scores {
+		b := 0.0
+		if width > 0 {
+			b = math.Min(math.Floor((s-lo)/width), float64(n-1))
+		}
+		scores[i] = b
+	}
+}
+
+// Computes the spatial sort terms from source positions
+type spatialKeys struct {
+	fx, fy       float64 // focal point
+	maxDist      float64 // largest distance from the focal point
+	cos, sin     float64 // sweep direction
+	theta        float64 // sweep direction in radians
+	minProj, ext float64 // range of positions along the sweep
+}
+
+func newSpatialKeys(colors []SampledColor, opts SortOptions) spatialKeys {
+	xMin, xDiff, yMin, yDiff := positionBounds(colors)
+	theta := opts.Direction * math.Pi / 180
+	sk := spatialKeys{
+		fx:    xMin + opts.FocusX*xDiff,
+		fy:    yMin + opts.FocusY*yDiff,
+		cos:   math.Cos(theta),
+		sin:   math.Sin(theta),
+		theta: theta,
+	}
+	minProj, maxProj := math.Inf(1), math.Inf(-1)
+	for _, c := range colors {
+		dx, dy := float64(c.x)-sk.fx, float64(c.y)-sk.fy
+		sk.maxDist = math.Max(sk.maxDist, math.Hypot(dx, dy))
+		proj := float64(c.x)*sk.cos + float64(c.y)*sk.sin
+		minProj, maxProj = math.Min(minProj, proj), math.Max(maxProj, proj)
+	}
+	if sk.maxDist == 0 {
+		sk.maxDist = 1
+	}
+	sk.minProj, sk.ext = minProj, maxProj-minProj
+	if !(sk.ext > 0) {
+		sk.ext = 1
+	}
+	return sk
+}
+
+// Returns the normalized distance from the focal point, angle around it as
+// a fraction of a turn, and position along the sweep, each in [0, 1].
+func (sk *spatialKeys) keys(c SampledColor) (radius, angle, sweep float64) {
+	x, y := float64(c.x), float64(c.y)
+	dx, dy := x-sk.fx, y-sk.fy
+	radius = math.Hypot(dx, dy) / sk.maxDist
+	// y points down, so angles increase clockwise on screen
+	angle = math.Mod(math.Atan2(dy, dx)-sk.theta, 2*math.Pi)
+	if angle < 0 {
+		angle += 2 * math.Pi
+	}
+	angle /= 2 * math.Pi
+	sweep = (x*sk.cos + y*sk.sin - sk.minProj) / sk.ext
+	return radius, angle, sweep
+}
+
+// Returns the smallest source x and y positions of the colors and the
+// extents of their ranges, which are at least 1.
+func positionBounds(colors []SampledColor) (xMin, xDiff, yMin, yDiff float64) {
+	if len(colors) == 0 {
+		return 0, 1, 0, 1
+	}
+	x0, y0 := colors[0].x, colors[0].y
+	x1, y1 := x0, y0
+	for _, c := range colors[1:] {
+		if c.x < x0 {
+			x0 = c.x
+		} else if c.x > x1 {
+			x1 = c.x
+		}
+		if c.y < y0 {
+			y0 = c.y
+		} else if c.y > y1 {
+			y1 = c.y
+		}
+	}
+	xDiff, yDiff = float64(x1-x0), float64(y1-y0)
+	if xDiff == 0 {
+		xDiff = 1
+	}
+	if yDiff == 0 {
+		yDiff = 1
+	}
+	return float64(x0), xDiff, float64(y0), yDiff
+}
+
+// Returns the position of the color along the curve. Every curve
+// spans the same range of codes as the Morton code over sRGB.
+func curveCode(c SampledColor, curve ColorCurve) uint32 {
+	switch curve {
+	case ColorCurveMortonRGB:
+		return uint32(c.rgbCode)
+	case ColorCurveHilbertRGB:
+		return hilbertCode(uint8(c.rgb.x), uint8(c.rgb.y), uint8(c.rgb.z))
+	}
+	// use 8-bit OkLab whatever the sampling precision so that codes share a range
+	lab := rgbToOkLab(c.rgb)
+	switch curve {
+	case ColorCurveMortonOkLab:
+		return uint32(mortonCode(lab.x, lab.y, lab.z))
+	case ColorCurveHilbertOkLab:
+		return hilbertCode(uint8(lab.x), uint8(lab.y), uint8(lab.z))
+	}
+	panic("curveCode: unknown color curve")
+}
+
+// Returns the hue angle h in degrees relative to the start angle and direction
+// given in opts, in [0, 360). Since hue wraps around, the start angle determines
+// where the sort order cuts the hue circle.
+func hueFrom(h float64, opts SortOptions) float64 {
+	d := h - opts.HueStart
+	if opts.HueReverse {
+		d = -d
+	}
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
@@ -0,0 +1,280 @@
+package pix
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHueFrom(t *testing.T) {
+	tests := []struct {
+		h, start float64
+		reverse  bool
+		want     float64
+	}{
+		{90, 0, false, 90},
+		{90, 120, false, 330},
+		{90, 120, true, 30},
+		{350, 10, true, 20},
+		{0, 0, true, 0},
+	}
+	for _, test := range tests {
+		got := hueFrom(test.h, SortOptions{HueStart: test.start, HueReverse: test.reverse})
+		if got != test.want {
+			t.Errorf("hueFrom(%v) with start %v, reverse %v: got %v; want %v", test.h, test.start, test.reverse, got, test.want)
+		}
+	}
+}
+
+func TestSortOkLCh(t *testing.T) {
+	var colors []SampledColor
+	for i, v := range []uint16{200, 50, 255, 0, 128} {
+		colors = append(colors, sampleColor(ImageColor{i, 0, v * 0x101, v * 0x101, v * 0x101}, uint32(i), SampleOptions{}))
+	}
+	SortBySimilarity(colors, SortOptions{Lightness: 1})
+	for i := 1; i < len(colors); i++ {
+		if colors[i].rgb.x < colors[i-1].rgb.x {
+			t.Fatalf("colors are not sorted by lightness: %v", colors)
+		}
+	}
+
+	// red, yellow, green and blue hues lie roughly at 29°, 110°, 142° and 264°
+	red, yellow, green, blue := Color{255, 0, 0}, Color{255, 255, 0}, Color{0, 255, 0}, Color{0, 0, 255}
+	colors = colors[:0]
+	for i, c := range []Color{blue, red, green, yellow} {
+		colors = append(colors, sampleColor(ImageColor{i, 0, c.x * 0x101, c.y * 0x101, c.z * 0x101}, uint32(i), SampleOptions{}))
+	}
+	SortBySimilarity(colors, SortOptions{Hue: 1, HueStart: 120, HueReverse: true})
+	for i, want := range []Color{yellow, red, blue, green} {
+		if colors[i].rgb != want {
+			t.Errorf("color %v: got %v; want %v", i, colors[i].rgb, want)
+		}
+	}
+}
+
+func TestColorCurves(t *testing.T) {
+	// the colors of the 8x8x8 cube at the origin, which the Hilbert curve fills first
+	var colors []SampledColor
+	for r := uint16(0); r < 8; r++ {
+		for g := uint16(0); g < 8; g++ {
+			for b := uint16(0); b < 8; b++ {
+				colors = append(colors, sampleColor(ImageColor{0, 0, r * 0x101, g * 0x101, b * 0x101}, 0, SampleOptions{}))
+			}
+		}
+	}
+	// consecutive colors along the Hilbert curve are adjacent in the color cube
+	SortBySimilarity(colors, SortOptions{Color: 1, ColorCurve: ColorCurveHilbertRGB})
+	for i := 1; i < len(colors); i++ {
+		if d := sqDist(colors[i].rgb, colors[i-1].rgb); d != 1 {
+			t.Fatalf("colors %v and %v are consecutive along the Hilbert curve but not adjacent", colors[i-1].rgb, colors[i].rgb)
+		}
+	}
+
+	for _, curve := range []ColorCurve{ColorCurveMortonRGB, ColorCurveHilbertRGB, ColorCurveMortonOkLab, ColorCurveHilbertOkLab} {
+		for _, c := range colors {
+			if code := curveCode(c, curve); code >= 1<<24 {
+				t.Errorf("curve %v: code %v for %v is out of range", curve, code, c.rgb)
+			}
+		}
+	}
+}
+
+func TestSpatialSort(t *testing.T) {
+	var colors []SampledColor
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 5; x++ {
+			colors = append(colors, sampleColor(ImageColor{x, y, 0, 0, 0}, 0, SampleOptions{}))
+		}
+	}
+	sq := func(c SampledColor) int32 { return (c.x-2)*(c.x-2) + (c.y-2)*(c.y-2) }
+
+	// colors grow outward from the center
+	SortBySimilarity(colors, SortOptions{Radial: 1, FocusX: 0.5, FocusY: 0.5})
+	if colors[0].x != 2 || colors[0].y != 2 {
+		t.Errorf("radial sort starts at (%v, %v); want the center", colors[0].x, colors[0].y)
+	}
+	for i := 1; i < len(colors); i++ {
+		if sq(colors[i]) < sq(colors[i-1]) {
+			t.Fatalf("radial sort is not ordered by distance from the center")
+		}
+	}
+
+	// a top-to-bottom sweep
+	SortBySimilarity(colors, SortOptions{Directional: 1, Direction: 90})
+	for i := 1; i < len(colors); i++ {
+		if colors[i].y < colors[i-1].y {
+			t.Fatalf("directional sort at 90° is not ordered top to bottom")
+		}
+	}
+
+	// clockwise around the center, starting from the right
+	SortBySimilarity(colors, SortOptions{Angular: 1, FocusX: 0.5, FocusY: 0.5})
+	var ring []SampledColor
+	for _, c := range colors {
+		if sq(c) == 1 {
+			ring = append(ring, c)
+		}
+	}
+	want := [][2]int32{{3, 2}, {2, 3}, {1, 2}, {2, 1}}
+	for i, c := range ring {
+		if c.x != want[i][0] || c.y != want[i][1] {
+			t.Errorf("angular sort: neighbor %v of the center is (%v, %v); want %v", i, c.x, c.y, want[i])
+		}
+	}
+}
+
+func TestSpatialSortSources(t *testing.T) {
+	solid := func(w, h int, v uint16) []ImageColor {
+		var colors []ImageColor
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				colors = append(colors, ImageColor{x, y, v, v, v})
+			}
+		}
+		return colors
+	}
+	// the sources lie side by side, so a left-to-right sweep takes
+	// every color of the left source before any of the right one
+	colors, err := SampleSources([]Source{{solid(4, 4, 0), 1, nil}, {solid(4, 4, 0xffff), 1, nil}}, 32, SampleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SortBySimilarity(colors, SortOptions{Directional: 1})
+	for i, c := range colors {
+		if left := i < 16; left != (c.rgb.x == 0) {
+			t.Fatalf("color %v of the directional sort is %v at (%v, %v)", i, c.rgb, c.x, c.y)
+		}
+	}
+
+	// the focal point lies between the sources, on their shared edge
+	SortBySimilarity(colors, SortOptions{Radial: 1, FocusX: 0.5, FocusY: 0.5})
+	for _, c := range colors[:4] {
+		if c.x != 3 && c.x != 4 {
+			t.Errorf("radial sort starts at (%v, %v); want the middle of the virtual image", c.x, c.y)
+		}
+	}
+}
+
+func TestSortSeed(t *testing.T) {
+	var colors []SampledColor
+	for i := 0; i < 64; i++ {
+		colors = append(colors, sampleColor(ImageColor{i, 0, uint16(i) * 0x404, 0, 0}, uint32(i), SampleOptions{}))
+	}
+	sorted := func(seed int64) []SampledColor {
+		c := append([]SampledColor(nil), colors...)
+		SortBySimilarity(c, SortOptions{Color: 1, Random: 10, Seed: seed})
+		return c
+	}
+	a, b, c := sorted(1), sorted(1), sorted(2)
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("sorting with the same seed gave different orders")
+		}
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Errorf("sorting with different seeds gave the same order")
+	}
+}
+
+func TestLexicographicSort(t *testing.T) {
+	// lightness bands, then hue within each band, then position
+	var colors []SampledColor
+	for i, c := range []Color{{250, 250, 250}, {200, 0, 0}, {0, 0, 200}, {30, 30, 30}, {0, 200, 0}, {240, 240, 240}, {20, 20, 20}} {
+		colors = append(colors, sampleColor(ImageColor{i, 0, c.x * 0x101, c.y * 0x101, c.z * 0x101}, uint32(i), SampleOptions{}))
+	}
+	keys := func(srcs ...string) []SortKey {
+		var keys []SortKey
+		for _, src := range srcs {
+			e, err := CompileSortExpr(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, SortKey{Expr: e})
+		}
+		return keys
+	}
+
+	k := keys("L", "hue")
+	k[0].Buckets = 3
+	SortBySimilarity(colors, SortOptions{Keys: k})
+	// bands split the range of lightness over the colors
+	lo, hi := 1.0, 0.0
+	for _, c := range colors {
+		L, _, _ := rgbToOkLCh(c.rgb)
+		lo, hi = math.Min(lo, L), math.Max(hi, L)
+	}
+	band := func(c SampledColor) int {
+		L, _, _ := rgbToOkLCh(c.rgb)
+		return int(math.Min(math.Floor((L-lo)/((hi-lo)/3)), 2))
+	}
+	for i := 1; i < len(colors); i++ {
+		a, b := colors[i-1], colors[i]
+		_, _, ha := rgbToOkLCh(a.rgb)
+		_, _, hb := rgbToOkLCh(b.rgb)
+		if band(a) > band(b) || band(a) == band(b) && ha > hb {
+			t.Fatalf("colors are not sorted by lightness band and then hue: %v", colors)
+		}
+	}
+
+	// ties keep their existing order, so sorting by a constant changes nothing,
+	// and a descending key is the negated expression
+	before := append([]SampledColor(nil), colors...)
+	SortBySimilarity(colors, SortOptions{Keys: keys("1")})
+	for i := range colors {
+		if colors[i].xyCode != before[i].xyCode {
+			t.Fatalf("sorting by a constant key changed the order")
+		}
+	}
+	SortBySimilarity(colors, SortOptions{Keys: keys("-x")})
+	for i := range colors {
+		if int(colors[i].x) != len(colors)-1-i {
+			t.Fatalf("sorting by -x did not reverse the source order: %v", colors)
+		}
+	}
+}
+
+func TestLocalShuffle(t *testing.T) {
+	colors := make([]SampledColor, 1000)
+	for i := range colors {
+		colors[i] = sampleColor(ImageColor{i, 0, 0, 0, 0}, uint32(i), SampleOptions{})
+	}
+	opts := SortOptions{Keys: []SortKey{{Expr: mustCompile(t, "x")}}, MaxDisplacement: 5, Seed: 1}
+	a := append([]SampledColor(nil), colors...)
+	SortBySimilarity(a, opts)
+	moved := 0
+	for i, c := range a {
+		if d := int(c.x) - i; d < -5 || d > 5 {
+			t.Fatalf("color %v moved %v places; want at most 5", c.x, d)
+		} else if d != 0 {
+			moved++
+		}
+	}
+	if moved < len(a)/2 {
+		t.Errorf("only %v of %v colors moved", moved, len(a))
+	}
+
+	// window shuffles keep the large-scale order and are reproducible
+	opts.MaxDisplacement, opts.ShuffleWindow = 0, 8
+	b, c := append([]SampledColor(nil), colors...), append([]SampledColor(nil), colors...)
+	SortBySimilarity(b, opts)
+	SortBySimilarity(c, opts)
+	var drift float64
+	for i := range b {
+		if b[i] != c[i] {
+			t.Fatalf("window shuffles with the same seed differ")
+		}
+		drift += math.Abs(float64(int(b[i].x) - i))
+	}
+	if mean := drift / float64(len(b)); mean == 0 || mean > 8 {
+		t.Errorf("mean displacement of a window shuffle is %v; want between 0 and 8", mean)
+	}
+}
+
+func mustCompile(t *testing.T, src string) *SortExpr {
+	e, err := CompileSortExpr(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
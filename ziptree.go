@@ -13,7 +13,8 @@ type Handle uint32
 const nilHandle = Handle(0)
 
 type zipNode struct {
-	rankAndKey  uint32 // 8-bit rank, then 24-bit morton code
+	key         MortonCode // 24-bit morton code (30-bit in high-precision mode)
+	rank        uint8
 	left, right Handle // handles to the left and right children in the pool
 }
 
@@ -22,12 +23,15 @@ type zipTree struct {
 	nodes []zipNode // pool of pre-allocated nodes
 	free  []Handle  // free list
 	rng   *rand.Rand
+	max   uint16      // largest channel value of the colors in the tree
+	w     axisWeights // weights of the axes in the distance metric used by Nearest
+	knn   []knnEntry  // scratch space for NearestK
 }
 
-func newZipTree(rng *rand.Rand) *zipTree {
+func newZipTree(rng *rand.Rand, max uint16, w axisWeights) *zipTree {
 	nodes := make([]zipNode, 1, 250_000)
 	free := make([]Handle, 0, 100_000)
-	return &zipTree{nilHandle, nodes, free, rng}
+	return &zipTree{nilHandle, nodes, free, rng, max, w, nil}
 }
 
 func (t *zipTree) Insert(key MortonCode) {
@@ -47,20 +51,17 @@ func (t *zipTree) Reset() {
 
 // take some bits from each of the r, g, b channels and use them to break rank ties.
 // tarjan calls these "fractional ranks" and suggests their use to improve the balance of
-// the tree, which are otherwise right-heavy                     rgbrgbrgbrgbrgbrgbrgbrgb
-func (x zipNode) Rank() uint32 { return x.rankAndKey & 0b11111111000000000000000000111000 }
+// the tree, which are otherwise right-heavy                        rgbrgbrgbrgbrgbrgbrgbrgb
+func (x zipNode) Rank() uint32 { return uint32(x.rank)<<24 | uint32(x.key)&0b111000 }
 
-func (x zipNode) Key() MortonCode {
-	return MortonCode(x.rankAndKey & 0b00000000111111111111111111111111)
-}
+func (x zipNode) Key() MortonCode { return x.key }
 
 func (t *zipTree) newZipNode(key MortonCode) Handle {
-	rank := uint32(0)
+	rank := uint8(0)
 	for t.rng.Int63()&1 == 0 {
 		rank++
 	}
-	rankAndKey := rank<<24 | uint32(key)
-	handle := t.Get(rankAndKey)
+	handle := t.Get(key, rank)
 	return handle
 }
 
@@ -177,16 +178,16 @@ func (t *zipTree) Put(handle Handle) {
 }
 
 // Get an unused handle from the pool
-func (t *zipTree) Get(rankAndKey uint32) Handle {
+func (t *zipTree) Get(key MortonCode, rank uint8) Handle {
 	n := len(t.free)
 	if n > 0 {
 		handle := t.free[n-1]
 		t.free = t.free[:n-1]
-		t.nodes[handle] = zipNode{rankAndKey, nilHandle, nilHandle}
+		t.nodes[handle] = zipNode{key, rank, nilHandle, nilHandle}
 		return handle
 	}
 	handle := Handle(len(t.nodes))
-	t.nodes = append(t.nodes, zipNode{rankAndKey, nilHandle, nilHandle})
+	t.nodes = append(t.nodes, zipNode{key, rank, nilHandle, nilHandle})
 	return handle
 }
 
@@ -198,8 +199,13 @@ func (t *zipTree) Get(rankAndKey uint32) Handle {
 // which alternately prunes the search space in Euclidean space and along the curve.
 // In our case we stores the points in a zip tree for dynamic updates, an perform the
 // search by recursively traversing the tree.
+//
+// Distances are squared Euclidean distances with each axis weighted by t.w.
+// Weighting keeps the pruning exact: the distance to a bounding box weights
+// its axes alike, and the box around the best radius extends along each axis
+// as far as a color within that weighted distance could lie.
 func (t *zipTree) Nearest(q Color, qCode MortonCode) MortonCode {
-	var rSq uint32 = 1 << 30
+	var rSq uint64 = math.MaxUint64
 	var best MortonCode
 	var qPosCode, qNegCode MortonCode
 	// todo: figure out why epsilon can be set to eg. 100000 with no ill effect
@@ -214,23 +220,19 @@ func (t *zipTree) Nearest(q Color, qCode MortonCode) MortonCode {
 		a := t.Node(ah)
 		midCode := a.Key()
 		mid := mortonCodeToColor(midCode)
-		dSq := sqDist(q, mid)
+		dSq := weightedSqDist(q, mid, t.w)
 		if dSq < rSq {
 			rSq = dSq
-			var r uint8
-			if dSq >= 255*255 {
-				r = 255
-			} else {
-				r = uint8(math.Ceil(math.Sqrt(float64(dSq))))
-			}
-			qPosCode = mortonCode(satAdd(q.x, r), satAdd(q.y, r), satAdd(q.z, r))
-			qNegCode = mortonCode(satSub(q.x, r), satSub(q.y, r), satSub(q.z, r))
+			max := t.max
+			r := t.w.radii(dSq, max)
+			qPosCode = mortonCode(satAdd(q.x, r[0], max), satAdd(q.y, r[1], max), satAdd(q.z, r[2], max))
+			qNegCode = mortonCode(satSub(q.x, r[0]), satSub(q.y, r[1]), satSub(q.z, r[2]))
 			best = midCode
 		}
 		// a.left is only equal to a.right if both are nilHandle
 		// We exclude searching intervals if the distance from the query point to the snug power-of-2 bounding box
 		// enclosing the interval is farther away than our best distance so far.
-		if a.left == a.right || midCode == qCode || distSqToBBox(qCode, t.MinKey(a), t.MaxKey(a), q) >= rSq {
+		if a.left == a.right || midCode == qCode || distSqToBBox(qCode, t.MinKey(a), t.MaxKey(a), q, t.w) >= rSq {
 			return
 		}
 		// If we can't exclude the interval, go ahead with a recursive search.
@@ -255,3 +257,68 @@ func (t *zipTree) Nearest(q Color, qCode MortonCode) MortonCode {
 	query(q, t.root)
 	return best
 }
+
+// A candidate of a k-nearest-neighbor search
+type knnEntry struct {
+	dSq  uint64
+	code MortonCode
+}
+
+// Like Nearest, but appends the codes of the k nearest colors in the tree to
+// dst, nearest first. Colors at the same distance as the k-th nearest may be
+// left out. The search prunes the tree against the distance to the k-th
+// nearest color found so far, rather than the nearest.
+func (t *zipTree) NearestK(q Color, qCode MortonCode, k int, dst []MortonCode) []MortonCode {
+	best := t.knn[:0]
+	rSq := uint64(math.MaxUint64)
+	max := t.max
+	qPosCode, qNegCode := mortonCode(max, max, max), MortonCode(0)
+	var query func(ah Handle)
+	query = func(ah Handle) {
+		if ah == 0 {
+			return
+		}
+		a := t.Node(ah)
+		midCode := a.Key()
+		dSq := weightedSqDist(q, mortonCodeToColor(midCode), t.w)
+		if dSq < rSq {
+			// insert the candidate in order, dropping the k+1-th
+			if len(best) < k {
+				best = append(best, knnEntry{})
+			}
+			i := len(best) - 1
+			for ; i > 0 && best[i-1].dSq > dSq; i-- {
+				best[i] = best[i-1]
+			}
+			best[i] = knnEntry{dSq, midCode}
+			if len(best) == k {
+				rSq = best[k-1].dSq
+				r := t.w.radii(rSq, max)
+				qPosCode = mortonCode(satAdd(q.x, r[0], max), satAdd(q.y, r[1], max), satAdd(q.z, r[2], max))
+				qNegCode = mortonCode(satSub(q.x, r[0]), satSub(q.y, r[1]), satSub(q.z, r[2]))
+			}
+		}
+		if a.left == a.right || distSqToBBox(qCode, t.MinKey(a), t.MaxKey(a), q, t.w) >= rSq {
+			return
+		}
+		if qCode <= midCode {
+			query(a.left)
+			if qPosCode >= midCode {
+				query(a.right)
+			}
+		} else {
+			query(a.right)
+			if qNegCode <= midCode {
+				query(a.left)
+			}
+		}
+	}
+	if k > 0 {
+		query(t.root)
+	}
+	t.knn = best
+	for _, e := range best {
+		dst = append(dst, e.code)
+	}
+	return dst
+}